@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step type of windowed aggregations
+const stepAggregate = "AGGREGATE"
+
+// Aggregate functions accepted in an AGGREGATE step
+var supportedAggregateFunctions = map[string]bool{
+	"COUNT":          true,
+	"SUM":            true,
+	"AVG":            true,
+	"MIN":            true,
+	"MAX":            true,
+	"DISTINCT_COUNT": true,
+}
+
+// AggregateConfig describes the windows, groups and aggregates of an AGGREGATE step
+type AggregateConfig struct {
+	// Window is the window size, Slide the interval between window starts. Windows
+	// tumble when Slide is empty or equal to Window.
+	Window string `yaml:"Window" json:"Window"`
+	Slide  string `yaml:"Slide,omitempty" json:"Slide,omitempty"`
+	// TimeField holds the event time of a record, processing time is used when empty
+	TimeField  string      `yaml:"TimeField,omitempty" json:"TimeField,omitempty"`
+	GroupBy    []string    `yaml:"GroupBy,omitempty" json:"GroupBy,omitempty"`
+	Aggregates []Aggregate `yaml:"Aggregates" json:"Aggregates"`
+}
+
+// Aggregate is one aggregate computed for every group of a window
+type Aggregate struct {
+	Function string `yaml:"Function" json:"Function"`
+	Field    string `yaml:"Field,omitempty" json:"Field,omitempty"`
+	As       string `yaml:"As,omitempty" json:"As,omitempty"`
+}
+
+// pipelineScope identifies the destination pipeline a transformation runs for. Preview
+// runs without a scope, so stateful steps only see the records of the batch.
+type pipelineScope struct {
+	sourceID    int
+	destination int
+}
+
+// aggregateState accumulates one aggregate of one group
+type aggregateState struct {
+	count    int64
+	sum      float64
+	min      interface{}
+	max      interface{}
+	distinct map[string]bool
+}
+
+// windowGroup holds the aggregates of one group inside one window
+type windowGroup struct {
+	keys   map[string]interface{}
+	states []*aggregateState
+}
+
+// windowAggregator keeps the open windows of one AGGREGATE step and emits their
+// results once they close
+type windowAggregator struct {
+	config    AggregateConfig
+	size      time.Duration
+	slide     time.Duration
+	windows   map[int64]map[string]*windowGroup
+	watermark time.Time
+	// Windows ending at or before closedUntil have been emitted
+	closedUntil time.Time
+	emit        func([]map[string]interface{})
+	mu          sync.Mutex
+	stop        chan bool
+}
+
+// Global map of running aggregators keyed by source, destination and step index
+var windowAggregators = make(map[string]*windowAggregator)
+var aggregatorsMu sync.Mutex
+
+// newWindowAggregator parses the window sizes of an aggregate configuration
+func newWindowAggregator(config AggregateConfig, emit func([]map[string]interface{})) (*windowAggregator, error) {
+	size, err := parseDuration(config.Window)
+	if err != nil {
+		return nil, err
+	}
+	slide := size
+	if config.Slide != "" {
+		if slide, err = parseDuration(config.Slide); err != nil {
+			return nil, err
+		}
+	}
+	if size <= 0 || slide <= 0 || slide > size {
+		return nil, fmt.Errorf("window %s and slide %s are not valid", config.Window, config.Slide)
+	}
+
+	return &windowAggregator{
+		config:  config,
+		size:    size,
+		slide:   slide,
+		windows: make(map[int64]map[string]*windowGroup),
+		emit:    emit,
+	}, nil
+}
+
+// start closes the windows whose end has passed, checking at least every second
+func (a *windowAggregator) start() {
+	interval := a.slide
+	if interval > time.Second {
+		interval = time.Second
+	}
+	a.stop = make(chan bool)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if a.config.TimeField == "" {
+					a.flush(now)
+				}
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+// add puts each record into every window covering its time
+func (a *windowAggregator) add(records []map[string]interface{}, now time.Time) {
+	a.mu.Lock()
+	for _, record := range records {
+		at := now
+		if a.config.TimeField != "" {
+			value, _ := ruleValue(record, a.config.TimeField)
+			eventTime, err := expressionTime(value)
+			if err != nil {
+				log.Printf("Skipping record without a valid %s: %v", a.config.TimeField, err)
+				continue
+			}
+			at = eventTime
+			if at.After(a.watermark) {
+				a.watermark = at
+			}
+		}
+
+		// The latest window starting at or before the record, then every earlier one
+		// that still covers it
+		start := at.Truncate(a.slide)
+		for ; start.Add(a.size).After(at); start = start.Add(-a.slide) {
+			if !start.Add(a.size).After(a.closedUntil) {
+				// The window has already been emitted
+				log.Printf("Dropping late record for window starting %s", start.Format(time.RFC3339))
+				continue
+			}
+			a.addToWindow(start, record)
+		}
+	}
+	watermark := a.watermark
+	a.mu.Unlock()
+
+	// Batches aggregated at once have nothing to emit to and flush everything instead
+	if a.config.TimeField != "" && a.emit != nil {
+		a.flush(watermark)
+	}
+}
+
+// addToWindow updates the aggregates of the record's group in one window
+func (a *windowAggregator) addToWindow(start time.Time, record map[string]interface{}) {
+	groups, exists := a.windows[start.UnixNano()]
+	if !exists {
+		groups = make(map[string]*windowGroup)
+		a.windows[start.UnixNano()] = groups
+	}
+
+	// Without GroupBy the whole window is a single group
+	key := ""
+	if len(a.config.GroupBy) > 0 {
+		key = recordKey(record, a.config.GroupBy)
+	}
+	group, exists := groups[key]
+	if !exists {
+		group = &windowGroup{keys: make(map[string]interface{}, len(a.config.GroupBy))}
+		for _, field := range a.config.GroupBy {
+			group.keys[field], _ = ruleValue(record, field)
+		}
+		for range a.config.Aggregates {
+			group.states = append(group.states, &aggregateState{distinct: make(map[string]bool)})
+		}
+		groups[key] = group
+	}
+
+	for i, aggregate := range a.config.Aggregates {
+		state := group.states[i]
+		value, exists := ruleValue(record, aggregate.Field)
+		if aggregate.Field != "" && (!exists || value == nil) {
+			continue
+		}
+		state.count++
+		if number, err := toFloat(value); err == nil {
+			state.sum += number
+		}
+		if state.min == nil || compareValues(value, state.min) < 0 {
+			state.min = value
+		}
+		if state.max == nil || compareValues(value, state.max) > 0 {
+			state.max = value
+		}
+		state.distinct[toString(value)] = true
+	}
+}
+
+// flush emits every window that ended at or before until
+func (a *windowAggregator) flush(until time.Time) {
+	a.mu.Lock()
+	var results []map[string]interface{}
+	for _, startNano := range a.windowStarts() {
+		start := time.Unix(0, startNano)
+		if start.Add(a.size).After(until) {
+			continue
+		}
+		results = append(results, a.windowResults(start, a.windows[startNano])...)
+		delete(a.windows, startNano)
+	}
+	if until.After(a.closedUntil) {
+		a.closedUntil = until
+	}
+	a.mu.Unlock()
+
+	if len(results) > 0 {
+		a.emit(results)
+	}
+}
+
+// flushAll emits every open window, used when a batch is aggregated at once
+func (a *windowAggregator) flushAll() []map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var results []map[string]interface{}
+	for _, startNano := range a.windowStarts() {
+		results = append(results, a.windowResults(time.Unix(0, startNano), a.windows[startNano])...)
+		delete(a.windows, startNano)
+	}
+	return results
+}
+
+// windowStarts returns the start of every open window, oldest first
+func (a *windowAggregator) windowStarts() []int64 {
+	starts := make([]int64, 0, len(a.windows))
+	for startNano := range a.windows {
+		starts = append(starts, startNano)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts
+}
+
+// windowResults builds one output record per group of a window
+func (a *windowAggregator) windowResults(start time.Time, groups map[string]*windowGroup) []map[string]interface{} {
+	results := make([]map[string]interface{}, 0, len(groups))
+	for _, group := range groups {
+		result := make(map[string]interface{}, len(group.keys)+len(a.config.Aggregates)+2)
+		for field, value := range group.keys {
+			result[field] = value
+		}
+		result["window_start"] = start.UTC().Format(time.RFC3339)
+		result["window_end"] = start.Add(a.size).UTC().Format(time.RFC3339)
+
+		for i, aggregate := range a.config.Aggregates {
+			state := group.states[i]
+			var value interface{}
+			switch strings.ToUpper(aggregate.Function) {
+			case "COUNT":
+				value = state.count
+			case "SUM":
+				value = state.sum
+			case "AVG":
+				if state.count > 0 {
+					value = state.sum / float64(state.count)
+				}
+			case "MIN":
+				value = state.min
+			case "MAX":
+				value = state.max
+			case "DISTINCT_COUNT":
+				value = len(state.distinct)
+			}
+			result[aggregateName(aggregate)] = value
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// aggregateName is the output field of an aggregate, e.g. sum_SaleAmount
+func aggregateName(aggregate Aggregate) string {
+	if aggregate.As != "" {
+		return aggregate.As
+	}
+	if aggregate.Field == "" {
+		return strings.ToLower(aggregate.Function)
+	}
+	return strings.ToLower(aggregate.Function) + "_" + aggregate.Field
+}
+
+// aggregateRecords runs an AGGREGATE step. Without a scope the batch is aggregated at
+// once and returned. With a scope the records are added to the running windows and the
+// results continue through the remaining steps when their window closes.
+func aggregateRecords(scope *pipelineScope, stepIndex int, records []map[string]interface{}, step TransformationStep, remaining []TransformationStep, outputFormat []outputRuleStructure, result *transformResult) []map[string]interface{} {
+	if step.Aggregate == nil {
+		return records
+	}
+
+	if scope == nil {
+		aggregator, err := newWindowAggregator(*step.Aggregate, nil)
+		if err != nil {
+			for index, record := range records {
+				result.reject(index, record, err)
+			}
+			result.origins = nil
+			return nil
+		}
+		aggregator.add(records, time.Now())
+		// Aggregates come from several records and have no origin
+		result.origins = nil
+		return aggregator.flushAll()
+	}
+
+	// The windows keep delivering to the destination they were opened for
+	var destination *Config
+	if config, ok := getDestinationConfig(scope.sourceID); ok && scope.destination < len(config.Config) {
+		destination = &config.Config[scope.destination]
+	}
+	aggregator, err := getWindowAggregator(*scope, stepIndex, *step.Aggregate, func(results []map[string]interface{}) {
+		emitAggregates(*scope, destination, results, remaining, outputFormat)
+	})
+	if err != nil {
+		for index, record := range records {
+			result.reject(index, record, err)
+		}
+		result.origins = nil
+		return nil
+	}
+	aggregator.add(records, time.Now())
+	result.origins = nil
+	return nil
+}
+
+// getWindowAggregator returns the running aggregator of a step, starting it on first use
+func getWindowAggregator(scope pipelineScope, stepIndex int, config AggregateConfig, emit func([]map[string]interface{})) (*windowAggregator, error) {
+	name := fmt.Sprintf("%d/%d/%d", scope.sourceID, scope.destination, stepIndex)
+
+	aggregatorsMu.Lock()
+	defer aggregatorsMu.Unlock()
+	if aggregator, exists := windowAggregators[name]; exists {
+		return aggregator, nil
+	}
+
+	aggregator, err := newWindowAggregator(config, emit)
+	if err != nil {
+		return nil, err
+	}
+	aggregator.start()
+	windowAggregators[name] = aggregator
+	return aggregator, nil
+}
+
+// resetWindowAggregators stops the aggregators of a source when its destinations are
+// redeployed. Windows that are still open are emitted early rather than dropped.
+func resetWindowAggregators(sourceID int) {
+	prefix := fmt.Sprintf("%d/", sourceID)
+
+	aggregatorsMu.Lock()
+	var stale []*windowAggregator
+	for name, aggregator := range windowAggregators {
+		if strings.HasPrefix(name, prefix) {
+			stale = append(stale, aggregator)
+			delete(windowAggregators, name)
+			log.Println("Stopped aggregation", name)
+		}
+	}
+	aggregatorsMu.Unlock()
+
+	for _, aggregator := range stale {
+		close(aggregator.stop)
+		if results := aggregator.flushAll(); len(results) > 0 {
+			aggregator.emit(results)
+		}
+	}
+}
+
+// emitAggregates sends the results of closed windows through the rest of the pipeline
+// and on to the destination the windows were opened for
+func emitAggregates(scope pipelineScope, destination *Config, records []map[string]interface{}, remaining []TransformationStep, outputFormat []outputRuleStructure) {
+	result := transformResult{}
+	records = runSteps(&scope, records, remaining, outputFormat, &result)
+	records = mapRecords(records, outputFormat, &result)
+	for _, recordErr := range result.Errors {
+		sendToDeadLetter(scope.sourceID, recordErr.Record, recordErr.Error)
+	}
+	if len(records) == 0 || destination == nil {
+		return
+	}
+
+	output, err := json.Marshal(records)
+	if err != nil {
+		log.Println("Error marshalling aggregates:", err)
+		return
+	}
+	if err := deliverOutput(scope.sourceID, scope.destination, *destination, output); err != nil {
+		log.Println("Error delivering aggregates:", err)
+	}
+}
+
+// hasAggregation reports whether a transformation keeps window state
+func hasAggregation(transformation finalOutputDataJSON) bool {
+	for _, step := range transformation.Steps {
+		if strings.ToUpper(step.Type) == stepAggregate {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAggregate checks the windows and aggregates of an AGGREGATE step
+func validateAggregate(errs *ValidationErrors, field string, config *AggregateConfig) {
+	if config == nil {
+		errs.add(field, "is required for AGGREGATE")
+		return
+	}
+	if _, err := newWindowAggregator(*config, nil); err != nil {
+		errs.add(field+".Window", "%v", err)
+	}
+	if len(config.Aggregates) == 0 {
+		errs.add(field+".Aggregates", "at least one aggregate is required")
+	}
+	for i, aggregate := range config.Aggregates {
+		aggregateField := fmt.Sprintf("%s.Aggregates[%d]", field, i)
+		function := strings.ToUpper(aggregate.Function)
+		if !supportedAggregateFunctions[function] {
+			errs.add(aggregateField+".Function", "unsupported aggregate %q", aggregate.Function)
+		}
+		if function != "COUNT" {
+			requireField(errs, aggregateField+".Field", aggregate.Field)
+		}
+	}
+}
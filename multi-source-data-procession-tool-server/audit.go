@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditEntry records a change made through the management API
+type auditEntry struct {
+	Timestamp time.Time         `json:"timestamp"`
+	User      string            `json:"user"`
+	Role      string            `json:"role,omitempty"`
+	Action    string            `json:"action"`
+	Params    map[string]string `json:"params,omitempty"`
+	Status    int               `json:"status"`
+	Version   int               `json:"version,omitempty"`
+}
+
+// Routes changing or deploying a configuration, the only ones kept in the audit log
+var auditedRoutes = map[string]bool{
+	"POST /updateConfiguration":   true,
+	"POST /refreshConfiguration":  true,
+	"POST /rollbackConfiguration": true,
+	"POST /stopWorker":            true,
+}
+
+// auditDetails is filled by the handlers of an audited request with what they changed
+type auditDetails struct {
+	version int
+}
+
+// auditDetailsKey stores the audit details in the request context
+type auditDetailsKey struct{}
+
+// recordAuditVersion adds the configuration version saved by a request to its audit entry
+func recordAuditVersion(ctx context.Context, version int) {
+	if details, ok := ctx.Value(auditDetailsKey{}).(*auditDetails); ok {
+		details.version = version
+	}
+}
+
+// Serialises the writes to the audit log
+var auditMu sync.Mutex
+
+// auditLogPath returns the path of the audit log, AUDIT_LOG when set
+func auditLogPath() string {
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		return path
+	}
+	return filepath.Join(configDir(), "audit.log")
+}
+
+// newAuditEntry describes a request answered with status
+func newAuditEntry(r *http.Request, caller identity, status int) auditEntry {
+	entry := auditEntry{
+		Timestamp: time.Now().UTC(),
+		User:      caller.Name,
+		Role:      caller.Role,
+		Action:    r.Method + " " + r.URL.Path,
+		Status:    status,
+	}
+	if entry.User == "" {
+		entry.User = "anonymous"
+	}
+	if query := r.URL.Query(); len(query) > 0 {
+		entry.Params = make(map[string]string, len(query))
+		for name := range query {
+			entry.Params[name] = query.Get(name)
+		}
+	}
+	return entry
+}
+
+// writeAudit appends an entry to the audit log, one JSON entry per line
+func writeAudit(entry auditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Error marshalling audit entry:", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(auditLogPath()), 0755); err != nil {
+		log.Println("Error creating audit log directory:", err)
+		return
+	}
+	if err := publishDataToFile(auditLogPath(), data); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
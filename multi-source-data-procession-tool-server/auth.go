@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// Roles of the management API, each one can do everything the previous ones can
+const (
+	roleViewer   = "viewer"
+	roleEditor   = "editor"
+	roleOperator = "operator"
+)
+
+// Rank of each role
+var roleRanks = map[string]int{
+	roleViewer:   1,
+	roleEditor:   2,
+	roleOperator: 3,
+}
+
+// Role required by each route, routes missing here require the operator role
+var routeRoles = map[string]string{
+	"GET /health":                 "",
+	"GET /.well-known/alive":      "",
+	"GET /.well-known/health":     "",
+	"GET /loadConfiguration":      roleViewer,
+	"GET /configurationVersions":  roleViewer,
+	"GET /configurationDiff":      roleViewer,
+	"POST /preview":               roleViewer,
+	"POST /updateConfiguration":   roleEditor,
+	"POST /refreshConfiguration":  roleOperator,
+	"POST /rollbackConfiguration": roleOperator,
+	"POST /stopWorker":            roleOperator,
+}
+
+// AuthConfig lists the API keys and the JWT settings accepted by the management API.
+// Keys and JWT secrets may be secret references such as "${env:ADMIN_KEY}".
+type AuthConfig struct {
+	APIKeys []APIKey   `yaml:"APIKeys"`
+	JWT     *JWTConfig `yaml:"JWT,omitempty"`
+}
+
+// APIKey is a static key sent in the X-API-Key header
+type APIKey struct {
+	Name string `yaml:"Name"`
+	Key  string `yaml:"Key"`
+	Role string `yaml:"Role"`
+}
+
+// JWTConfig validates bearer tokens signed with an HMAC Secret or with the RSA key in
+// PublicKeyFile. The name and role of the caller are read from SubjectClaim ("sub" by
+// default) and RoleClaim ("role" by default).
+type JWTConfig struct {
+	Secret        string `yaml:"Secret,omitempty"`
+	PublicKeyFile string `yaml:"PublicKeyFile,omitempty"`
+	Issuer        string `yaml:"Issuer,omitempty"`
+	Audience      string `yaml:"Audience,omitempty"`
+	SubjectClaim  string `yaml:"SubjectClaim,omitempty"`
+	RoleClaim     string `yaml:"RoleClaim,omitempty"`
+}
+
+// identity is the authenticated caller of a request
+type identity struct {
+	Name string
+	Role string
+}
+
+// identityKey stores the identity in the request context
+type identityKey struct{}
+
+// authenticator checks the credentials of the requests
+type authenticator struct {
+	config    AuthConfig
+	verifyKey interface{}
+	methods   []string
+}
+
+// authConfigPath returns the path of the auth configuration, AUTH_CONFIG when set
+func authConfigPath() string {
+	if path := os.Getenv("AUTH_CONFIG"); path != "" {
+		return path
+	}
+	return filepath.Join(configDir(), "auth.yaml")
+}
+
+// loadAuthenticator reads the auth configuration. It returns nil when there is none.
+func loadAuthenticator() (*authenticator, error) {
+	data, err := ioutil.ReadFile(authConfigPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config AuthConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	a := &authenticator{config: config}
+	for i, key := range a.config.APIKeys {
+		if _, ok := roleRanks[key.Role]; !ok {
+			return nil, fmt.Errorf("API key %q has unknown role %q", key.Name, key.Role)
+		}
+		if a.config.APIKeys[i].Key, err = resolveSecret(key.Key); err != nil {
+			return nil, fmt.Errorf("API key %q: %v", key.Name, err)
+		}
+	}
+
+	if jwtConfig := a.config.JWT; jwtConfig != nil {
+		switch {
+		case jwtConfig.PublicKeyFile != "":
+			pem, err := ioutil.ReadFile(jwtConfig.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if a.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+				return nil, err
+			}
+			a.methods = []string{"RS256", "RS384", "RS512"}
+		case jwtConfig.Secret != "":
+			secret, err := resolveSecret(jwtConfig.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("JWT secret: %v", err)
+			}
+			a.verifyKey = []byte(secret)
+			a.methods = []string{"HS256", "HS384", "HS512"}
+		default:
+			return nil, errors.New("JWT requires a Secret or a PublicKeyFile")
+		}
+	}
+	return a, nil
+}
+
+// authenticate returns the identity of the caller of a request
+func (a *authenticator) authenticate(r *http.Request) (identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		for _, apiKey := range a.config.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey.Key)) == 1 {
+				return identity{Name: apiKey.Name, Role: apiKey.Role}, nil
+			}
+		}
+		return identity{}, errors.New("invalid API key")
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") && a.config.JWT != nil {
+		return a.parseToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	return identity{}, errors.New("missing credentials")
+}
+
+// parseToken validates a JWT and reads the name and role of the caller from its claims
+func (a *authenticator) parseToken(tokenText string) (identity, error) {
+	options := []jwt.ParserOption{jwt.WithValidMethods(a.methods), jwt.WithExpirationRequired()}
+	if a.config.JWT.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.config.JWT.Issuer))
+	}
+	if a.config.JWT.Audience != "" {
+		options = append(options, jwt.WithAudience(a.config.JWT.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenText, claims, func(*jwt.Token) (interface{}, error) {
+		return a.verifyKey, nil
+	}, options...)
+	if err != nil {
+		return identity{}, fmt.Errorf("invalid token: %v", err)
+	}
+
+	subjectClaim, roleClaim := a.config.JWT.SubjectClaim, a.config.JWT.RoleClaim
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+	if roleClaim == "" {
+		roleClaim = "role"
+	}
+	name, _ := claims[subjectClaim].(string)
+	role, _ := claims[roleClaim].(string)
+	if _, ok := roleRanks[role]; !ok || name == "" {
+		return identity{}, errors.New("token has no valid subject and role")
+	}
+	return identity{Name: name, Role: role}, nil
+}
+
+// authMiddleware authenticates the requests of the management API, checks the role
+// required by their route and records the changes in the audit log. Without an
+// authenticator every request is allowed.
+func authMiddleware(a *authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			required, known := routeRoles[r.Method+" "+r.URL.Path]
+			if !known {
+				required = roleOperator
+			}
+
+			// Changes and deployments are kept in the audit log
+			audited := auditedRoutes[r.Method+" "+r.URL.Path]
+
+			caller := identity{}
+			if a != nil && required != "" {
+				var err error
+				caller, err = a.authenticate(r)
+				if err != nil {
+					writeAuthError(w, http.StatusUnauthorized, err.Error())
+					if audited {
+						writeAudit(newAuditEntry(r, caller, http.StatusUnauthorized))
+					}
+					return
+				}
+				if roleRanks[caller.Role] < roleRanks[required] {
+					writeAuthError(w, http.StatusForbidden, fmt.Sprintf("role %s is required", required))
+					if audited {
+						writeAudit(newAuditEntry(r, caller, http.StatusForbidden))
+					}
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, caller))
+			}
+
+			if !audited {
+				next.ServeHTTP(w, r)
+				return
+			}
+			details := &auditDetails{}
+			r = r.WithContext(context.WithValue(r.Context(), auditDetailsKey{}, details))
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			entry := newAuditEntry(r, caller, recorder.status)
+			entry.Version = details.version
+			writeAudit(entry)
+		})
+	}
+}
+
+// writeAuthError responds with an error in the format of GoFr
+func writeAuthError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"message": message},
+	})
+}
+
+// requestIdentity returns the authenticated caller of a request
+func requestIdentity(ctx context.Context) (identity, bool) {
+	caller, ok := ctx.Value(identityKey{}).(identity)
+	return caller, ok
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// newAuthMiddleware loads the auth configuration and returns the middleware protecting
+// the routes of the app
+func newAuthMiddleware() func(http.Handler) http.Handler {
+	a, err := loadAuthenticator()
+	if err != nil {
+		log.Fatal("Failed to load auth configuration:", err)
+	}
+	if a == nil {
+		// The management API is only left open on purpose
+		if os.Getenv("AUTH_DISABLED") != "true" {
+			log.Fatal("No auth configuration found at ", authConfigPath(), ", set AUTH_DISABLED=true to run without authentication")
+		}
+		log.Println("AUTH_DISABLED is set - the management API is not protected")
+	}
+	return authMiddleware(a)
+}
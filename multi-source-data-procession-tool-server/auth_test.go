@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthMiddlewareAudit(t *testing.T) {
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv("AUDIT_LOG", auditLog)
+
+	a := &authenticator{config: AuthConfig{APIKeys: []APIKey{
+		{Name: "alice", Key: "editor-key", Role: roleEditor},
+		{Name: "bob", Key: "viewer-key", Role: roleViewer},
+	}}}
+	handler := authMiddleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordAuditVersion(r.Context(), 7)
+	}))
+
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		status int
+	}{
+		{method: http.MethodPost, path: "/updateConfiguration", key: "editor-key", status: http.StatusOK},
+		{method: http.MethodPost, path: "/updateConfiguration", key: "viewer-key", status: http.StatusForbidden},
+		{method: http.MethodPost, path: "/updateConfiguration", status: http.StatusUnauthorized},
+		{method: http.MethodPost, path: "/preview", key: "viewer-key", status: http.StatusOK},
+		{method: http.MethodGet, path: "/loadConfiguration", key: "viewer-key", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, nil)
+		if test.key != "" {
+			request.Header.Set("X-API-Key", test.key)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s with %q = %d, want %d", test.method, test.path, test.key, recorder.Code, test.status)
+		}
+	}
+
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("audit log has %d entries, want the 3 /updateConfiguration requests:\n%s", len(lines), data)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.User != "alice" || entry.Status != http.StatusOK || entry.Version != 7 {
+		t.Errorf("audit entry = %+v, want alice, 200 and version 7", entry)
+	}
+}
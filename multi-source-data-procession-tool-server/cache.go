@@ -0,0 +1,65 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Number of entries kept by each compiled value cache
+const compiledCacheSize = 1024
+
+// boundedCache keeps the most recently used values up to a fixed number of entries, so
+// that expressions, patterns and paths compiled from incoming requests cannot grow the
+// memory of the server without limit
+type boundedCache struct {
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	mu       sync.Mutex
+}
+
+// cacheEntry is a key and its value in the recency list of a cache
+type cacheEntry struct {
+	key   string
+	value interface{}
+}
+
+// newBoundedCache returns an empty cache holding at most capacity entries
+func newBoundedCache(capacity int) *boundedCache {
+	return &boundedCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the value of a key and marks it as recently used
+func (c *boundedCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).value, true
+}
+
+// add stores the value of a key, evicting the least recently used entry when full
+func (c *boundedCache) add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
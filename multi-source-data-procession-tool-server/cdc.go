@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Interval of the status updates sent to PostgreSQL while replicating
+const cdcStatusInterval = 10 * time.Second
+
+// Delay before reconnecting after the replication stopped on an error
+const cdcRetryDelay = 5 * time.Second
+
+// SQLSTATE returned when the replication slot already exists
+const duplicateObjectCode = "42710"
+
+// Number of events of a transaction kept in memory. Larger transactions are processed
+// in several batches, and only confirmed once they commit.
+const cdcMaxBufferedEvents = 1000
+
+// cdcEvent is a row change read from the PostgreSQL write ahead log
+type cdcEvent struct {
+	Op         string                 `json:"op"`
+	Schema     string                 `json:"schema"`
+	Table      string                 `json:"table"`
+	LSN        string                 `json:"lsn"`
+	CommitTime string                 `json:"commit_time"`
+	Before     map[string]interface{} `json:"before"`
+	After      map[string]interface{} `json:"after"`
+}
+
+// cdcStream decodes the pgoutput messages of a replication connection and hands the
+// events of the transactions to process
+type cdcStream struct {
+	relations map[uint32]*pglogrepl.RelationMessage
+	types     *pgtype.Map
+	events    []cdcEvent
+	process   func(data []byte) error
+	commitLSN pglogrepl.LSN
+
+	// Commit LSN and time of the open transaction, announced by its BEGIN
+	inTransaction bool
+	finalLSN      pglogrepl.LSN
+	commitTime    time.Time
+}
+
+// handlePostgresCDC streams the row changes of the tables of a publication through a
+// logical replication slot. Each committed transaction is processed as one batch of
+// insert, update and delete events, then confirmed to PostgreSQL and stored once it was
+// delivered, so a restart resumes after the last delivered transaction. A transaction
+// that cannot be delivered stops the replication, which reconnects from the last
+// confirmed position and reads it again. A connector retired by its stop channel drops
+// its slot, which would otherwise keep the WAL on the server.
+func handlePostgresCDC(sourceID int, connector int, config Config, stopChan chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	retired := make(chan bool, 1)
+	go func() {
+		retired <- <-stopChan
+		cancel()
+	}()
+
+	process := func(data []byte) error {
+		if data, ok := ingestData(sourceID, data); ok {
+			return processData(sourceID, data)
+		}
+		return nil
+	}
+	for ctx.Err() == nil {
+		err := replicate(ctx, sourceID, connector, config, process)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Println("Replication stopped:", err)
+
+		select {
+		case <-time.After(cdcRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	fmt.Printf("%s is stopping...\n", "POSTGRES_CDC")
+	if <-retired {
+		if err := dropReplicationSlot(sourceID, connector, config); err != nil {
+			log.Println("Failed to drop replication slot:", err)
+		}
+	}
+}
+
+// dropReplicationSlot drops the slot of a retired CDC connector and forgets its position
+func dropReplicationSlot(sourceID int, connector int, config Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cdcRetryDelay*6)
+	defer cancel()
+
+	conn, err := pgconn.Connect(ctx, replicationURL(config))
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	// WAIT lets a connection still closing on the server release the slot first
+	if err := pglogrepl.DropReplicationSlot(ctx, conn, config.Slot, pglogrepl.DropReplicationSlotOptions{Wait: true}); err != nil {
+		return err
+	}
+	log.Println("Dropped replication slot", config.Slot)
+	if err := os.Remove(lsnPath(sourceID, connector)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// cdcSlotKey identifies the replication slot of a CDC connector on its server
+func cdcSlotKey(config Config) string {
+	return fmt.Sprintf("%s:%d/%s/%s", config.DBHost, config.DBPort, config.DBName, config.Slot)
+}
+
+// replicationURL returns the connection string of a replication connection
+func replicationURL(config Config) string {
+	query := url.Values{"replication": {"database"}}
+	if config.DBSSLMode != "" {
+		query.Set("sslmode", config.DBSSLMode)
+	}
+	connURL := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(config.DBUser, config.DBPassword),
+		Host:     fmt.Sprintf("%s:%d", config.DBHost, config.DBPort),
+		Path:     "/" + config.DBName,
+		RawQuery: query.Encode(),
+	}
+	return connURL.String()
+}
+
+// replicate runs one replication connection until it fails or ctx is cancelled, handing
+// the events of the transactions to process. It returns the error of a transaction that
+// could not be processed without confirming it.
+func replicate(ctx context.Context, sourceID int, connector int, config Config, process func(data []byte) error) error {
+	conn, err := pgconn.Connect(ctx, replicationURL(config))
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	// The slot keeps the changes while the source is stopped
+	_, err = pglogrepl.CreateReplicationSlot(ctx, conn, config.Slot, "pgoutput", pglogrepl.CreateReplicationSlotOptions{})
+	var pgErr *pgconn.PgError
+	if err != nil && !(errors.As(err, &pgErr) && pgErr.Code == duplicateObjectCode) {
+		return fmt.Errorf("cannot create replication slot: %v", err)
+	}
+
+	// Resume after the last processed transaction, a zero LSN resumes from the slot
+	startLSN, err := loadConfirmedLSN(sourceID, connector)
+	if err != nil {
+		return err
+	}
+	err = pglogrepl.StartReplication(ctx, conn, config.Slot, startLSN, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", "publication_names '" + config.Publication + "'"},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot start replication: %v", err)
+	}
+	log.Println("Replication started from", startLSN)
+
+	stream := newCDCStream(process)
+	confirmed := startLSN
+	nextStatus := time.Now().Add(cdcStatusInterval)
+
+	for {
+		if time.Now().After(nextStatus) {
+			if err := sendStatus(ctx, conn, confirmed); err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(cdcStatusInterval)
+		}
+
+		receiveCtx, cancelReceive := context.WithDeadline(ctx, nextStatus)
+		message, err := conn.ReceiveMessage(receiveCtx)
+		cancelReceive()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return err
+		}
+
+		switch msg := message.(type) {
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("replication error: %s", msg.Message)
+		case *pgproto3.CopyData:
+			switch msg.Data[0] {
+			case pglogrepl.PrimaryKeepaliveMessageByteID:
+				keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+				if err != nil {
+					return err
+				}
+				// Outside of a transaction everything up to the end of the WAL sent so far
+				// was processed, which lets the server recycle the WAL of other databases
+				// and of the tables outside the publication
+				if !stream.inTransaction && keepalive.ServerWALEnd > confirmed {
+					confirmed = keepalive.ServerWALEnd
+					if err := saveConfirmedLSN(sourceID, connector, confirmed); err != nil {
+						log.Println("Failed to save replication position:", err)
+					}
+				}
+				if keepalive.ReplyRequested {
+					nextStatus = time.Time{}
+				}
+			case pglogrepl.XLogDataByteID:
+				xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+				if err != nil {
+					return err
+				}
+				committed, err := stream.handle(xld.WALData)
+				if err != nil {
+					return err
+				}
+				if committed {
+					confirmed = stream.commitLSN
+					if err := saveConfirmedLSN(sourceID, connector, confirmed); err != nil {
+						log.Println("Failed to save replication position:", err)
+					}
+					if err := sendStatus(ctx, conn, confirmed); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
+
+// sendStatus confirms to PostgreSQL that the changes up to lsn were processed
+func sendStatus(ctx context.Context, conn *pgconn.PgConn, lsn pglogrepl.LSN) error {
+	return pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: lsn})
+}
+
+// newCDCStream returns a stream handing the events it decodes to process
+func newCDCStream(process func(data []byte) error) *cdcStream {
+	return &cdcStream{
+		relations: make(map[uint32]*pglogrepl.RelationMessage),
+		types:     pgtype.NewMap(),
+		process:   process,
+	}
+}
+
+// handle decodes a pgoutput message. The events of a transaction are processed when it
+// commits, in which case handle returns true, or every cdcMaxBufferedEvents events.
+func (s *cdcStream) handle(walData []byte) (bool, error) {
+	message, err := pglogrepl.Parse(walData)
+	if err != nil {
+		return false, fmt.Errorf("cannot parse logical replication message: %v", err)
+	}
+
+	switch msg := message.(type) {
+	case *pglogrepl.RelationMessage:
+		s.relations[msg.RelationID] = msg
+	case *pglogrepl.BeginMessage:
+		s.events = s.events[:0]
+		s.inTransaction = true
+		s.finalLSN = msg.FinalLSN
+		s.commitTime = msg.CommitTime
+	case *pglogrepl.InsertMessage:
+		return false, s.addEvent(changeInsert, msg.RelationID, nil, msg.Tuple)
+	case *pglogrepl.UpdateMessage:
+		return false, s.addEvent(changeUpdate, msg.RelationID, msg.OldTuple, msg.NewTuple)
+	case *pglogrepl.DeleteMessage:
+		return false, s.addEvent(changeDelete, msg.RelationID, msg.OldTuple, nil)
+	case *pglogrepl.CommitMessage:
+		if err := s.flush(); err != nil {
+			return false, err
+		}
+		s.inTransaction = false
+		s.commitLSN = msg.TransactionEndLSN
+		return true, nil
+	}
+	return false, nil
+}
+
+// flush processes the buffered events of the open transaction and returns the error of
+// their delivery
+func (s *cdcStream) flush() error {
+	if len(s.events) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(s.events)
+	if err != nil {
+		return err
+	}
+	s.events = s.events[:0]
+	if err := s.process(data); err != nil {
+		return fmt.Errorf("cannot deliver changes: %v", err)
+	}
+	return nil
+}
+
+// addEvent adds a row change of the current transaction, processing the buffered events
+// once there are cdcMaxBufferedEvents of them. A restart in the middle of a transaction
+// processes its first events again.
+func (s *cdcStream) addEvent(op string, relationID uint32, before *pglogrepl.TupleData, after *pglogrepl.TupleData) error {
+	relation, ok := s.relations[relationID]
+	if !ok {
+		return fmt.Errorf("unknown relation %d", relationID)
+	}
+	s.events = append(s.events, cdcEvent{
+		Op:         op,
+		Schema:     relation.Namespace,
+		Table:      relation.RelationName,
+		LSN:        s.finalLSN.String(),
+		CommitTime: s.commitTime.UTC().Format(time.RFC3339Nano),
+		Before:     s.decodeTuple(relation, before),
+		After:      s.decodeTuple(relation, after),
+	})
+	if len(s.events) >= cdcMaxBufferedEvents {
+		return s.flush()
+	}
+	return nil
+}
+
+// decodeTuple converts the columns of a row to typed values. Old rows only hold their
+// key columns unless the table uses REPLICA IDENTITY FULL, and unchanged TOASTed values
+// are not sent.
+func (s *cdcStream) decodeTuple(relation *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) map[string]interface{} {
+	if tuple == nil {
+		return nil
+	}
+
+	row := make(map[string]interface{}, len(tuple.Columns))
+	for i, column := range tuple.Columns {
+		if i >= len(relation.Columns) {
+			break
+		}
+		name := relation.Columns[i].Name
+		switch column.DataType {
+		case 'n':
+			row[name] = nil
+		case 't':
+			typeName := ""
+			if dataType, ok := s.types.TypeForOID(relation.Columns[i].DataType); ok {
+				typeName = dataType.Name
+			}
+			row[name] = rawColumnValue(string(column.Data), typeName)
+		}
+	}
+	return row
+}
+
+// lsnPath returns the file holding the last LSN processed by a CDC connector
+func lsnPath(sourceID int, connector int) string {
+	return stateFilePath("lsn", sourceID, connector, "")
+}
+
+// loadConfirmedLSN returns the last LSN processed by a CDC connector, zero when none
+func loadConfirmedLSN(sourceID int, connector int) (pglogrepl.LSN, error) {
+	data, err := ioutil.ReadFile(lsnPath(sourceID, connector))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return pglogrepl.ParseLSN(strings.TrimSpace(string(data)))
+}
+
+// saveConfirmedLSN stores the last LSN processed by a CDC connector
+func saveConfirmedLSN(sourceID int, connector int, lsn pglogrepl.LSN) error {
+	path := lsnPath(sourceID, connector)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, []byte(lsn.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// validateCDC checks the connection, slot and publication of a PostgreSQL CDC source
+func validateCDC(errs *ValidationErrors, field string, config Config, isSource bool) {
+	if !isSource {
+		errs.add(field+".TYPE", "POSTGRES_CDC is only supported for sources")
+	}
+	requireField(errs, field+".DB_HOST", config.DBHost)
+	if config.DBPort <= 0 || config.DBPort > 65535 {
+		errs.add(field+".DB_PORT", "must be between 1 and 65535")
+	}
+	requireField(errs, field+".DB_USER", config.DBUser)
+	requireField(errs, field+".DB_NAME", config.DBName)
+
+	// Both names are written into replication commands
+	if !identifierPattern.MatchString(config.Slot) {
+		errs.add(field+".Slot", "must be a plain identifier")
+	}
+	if !identifierPattern.MatchString(config.Publication) {
+		errs.add(field+".Publication", "must be a plain identifier")
+	}
+}
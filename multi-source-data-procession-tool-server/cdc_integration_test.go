@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TestPostgresCDCIntegration streams an insert through a real replication slot. It runs
+// against the database of CDC_TEST_DSN, such as the one of docker-compose.test.yml.
+func TestPostgresCDCIntegration(t *testing.T) {
+	dsn := os.Getenv("CDC_TEST_DSN")
+	if dsn == "" {
+		t.Skip("CDC_TEST_DSN is not set, see docker-compose.test.yml")
+	}
+	t.Setenv("CONFIG_DIR", t.TempDir())
+
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(parsed.Port())
+	password, _ := parsed.User.Password()
+	config := Config{
+		Type:        "POSTGRES_CDC",
+		DBHost:      parsed.Hostname(),
+		DBPort:      port,
+		DBUser:      parsed.User.Username(),
+		DBPassword:  password,
+		DBName:      strings.TrimPrefix(parsed.Path, "/"),
+		DBSSLMode:   parsed.Query().Get("sslmode"),
+		Slot:        "cdc_integration_test",
+		Publication: "cdc_integration_test",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	conn, err := pgconn.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+	exec := func(sql string) {
+		t.Helper()
+		if _, err := conn.Exec(ctx, sql).ReadAll(); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	// A failed run leaves its slot behind, it would keep the changes of the next run
+	const dropSlot = "SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = 'cdc_integration_test' AND NOT active"
+	defer func() {
+		conn.Exec(context.Background(), dropSlot).ReadAll()
+	}()
+	exec(dropSlot)
+	exec("DROP TABLE IF EXISTS cdc_integration_test")
+	exec("CREATE TABLE cdc_integration_test (id bigint PRIMARY KEY, amount numeric, name text)")
+	exec("DROP PUBLICATION IF EXISTS cdc_integration_test")
+	exec("CREATE PUBLICATION cdc_integration_test FOR TABLE cdc_integration_test")
+
+	batches := make(chan []byte, 1)
+	replicateCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- replicate(replicateCtx, 1, 0, config, func(data []byte) error {
+			batches <- data
+			return nil
+		})
+	}()
+
+	// Changes are only kept once replicate created the slot
+	for !slotExists(t, ctx, conn) {
+		select {
+		case err := <-done:
+			t.Fatalf("replication stopped: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	exec("INSERT INTO cdc_integration_test VALUES (1, 12345678901234567890.25, 'Ada')")
+
+	var batch []byte
+	select {
+	case batch = <-batches:
+	case err := <-done:
+		t.Fatalf("replication stopped: %v", err)
+	case <-ctx.Done():
+		t.Fatal("no change received")
+	}
+	stop()
+	<-done
+
+	var events []cdcEvent
+	if err := json.Unmarshal(batch, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Op != changeInsert || events[0].Table != "cdc_integration_test" {
+		t.Fatalf("events = %+v, want one insert into cdc_integration_test", events)
+	}
+	if after := events[0].After; after["id"] != 1.0 || after["name"] != "Ada" {
+		t.Errorf("after = %v", after)
+	}
+	if !strings.Contains(string(batch), `"amount":12345678901234567890.25`) {
+		t.Errorf("numeric column lost its digits: %s", batch)
+	}
+
+	lsn, err := loadConfirmedLSN(1, 0)
+	if err != nil || lsn == 0 {
+		t.Errorf("confirmed LSN = %v, %v, want the commit of the insert", lsn, err)
+	}
+
+	// A retired connector drops its slot and forgets its position
+	if err := dropReplicationSlot(1, 0, config); err != nil {
+		t.Fatalf("dropReplicationSlot: %v", err)
+	}
+	if lsn, _ := loadConfirmedLSN(1, 0); lsn != 0 {
+		t.Errorf("confirmed LSN = %v after the slot was dropped", lsn)
+	}
+	if slotExists(t, ctx, conn) {
+		t.Error("replication slot still exists")
+	}
+}
+
+// slotExists reports whether the slot of the integration test exists
+func slotExists(t *testing.T, ctx context.Context, conn *pgconn.PgConn) bool {
+	t.Helper()
+	results, err := conn.Exec(ctx, "SELECT 1 FROM pg_replication_slots WHERE slot_name = 'cdc_integration_test'").ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(results[0].Rows) > 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestDecodeTuple(t *testing.T) {
+	relation := &pglogrepl.RelationMessage{
+		RelationID:   1,
+		Namespace:    "public",
+		RelationName: "orders",
+		Columns: []*pglogrepl.RelationMessageColumn{
+			{Name: "id", DataType: pgtype.Int8OID},
+			{Name: "amount", DataType: pgtype.NumericOID},
+			{Name: "note", DataType: pgtype.TextOID},
+			{Name: "paid", DataType: pgtype.BoolOID},
+			{Name: "details", DataType: pgtype.JSONBOID},
+			{Name: "created", DataType: pgtype.TimestamptzOID},
+		},
+	}
+	text := func(value string) *pglogrepl.TupleDataColumn {
+		return &pglogrepl.TupleDataColumn{DataType: 't', Data: []byte(value)}
+	}
+
+	tests := []struct {
+		name    string
+		columns []*pglogrepl.TupleDataColumn
+		want    map[string]interface{}
+	}{
+		{
+			name:    "text columns",
+			columns: []*pglogrepl.TupleDataColumn{text("9007199254740993"), text("10.10"), text("hello"), text("t"), text(`{"items": 2}`), text("2024-03-01 10:20:30+00")},
+			want: map[string]interface{}{
+				"id":      int64(9007199254740993),
+				"amount":  json.Number("10.10"),
+				"note":    "hello",
+				"paid":    true,
+				"details": map[string]interface{}{"items": int64(2)},
+				"created": "2024-03-01T10:20:30Z",
+			},
+		},
+		{
+			// Unchanged TOASTed values are not sent and stay out of the row
+			name:    "null and unchanged columns",
+			columns: []*pglogrepl.TupleDataColumn{text("1"), {DataType: 'n'}, {DataType: 'u'}},
+			want:    map[string]interface{}{"id": int64(1), "amount": nil},
+		},
+		{
+			name:    "more columns than the relation",
+			columns: []*pglogrepl.TupleDataColumn{text("1"), {DataType: 'n'}, {DataType: 'n'}, {DataType: 'n'}, {DataType: 'n'}, {DataType: 'n'}, text("extra")},
+			want:    map[string]interface{}{"id": int64(1), "amount": nil, "note": nil, "paid": nil, "details": nil, "created": nil},
+		},
+	}
+
+	stream := newCDCStream(func([]byte) error { return nil })
+	for _, test := range tests {
+		got := stream.decodeTuple(relation, &pglogrepl.TupleData{Columns: test.columns})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: decodeTuple = %#v, want %#v", test.name, got, test.want)
+		}
+	}
+	if got := stream.decodeTuple(relation, nil); got != nil {
+		t.Errorf("decodeTuple(nil) = %#v, want nil", got)
+	}
+}
+
+func TestCDCStreamBuffering(t *testing.T) {
+	relation := &pglogrepl.RelationMessage{
+		RelationID:   1,
+		RelationName: "orders",
+		Columns:      []*pglogrepl.RelationMessageColumn{{Name: "id", DataType: pgtype.Int8OID}},
+	}
+	tuple := &pglogrepl.TupleData{Columns: []*pglogrepl.TupleDataColumn{{DataType: 't', Data: []byte("1")}}}
+
+	tests := []struct {
+		events      int
+		commit      bool
+		wantBatches []int
+	}{
+		{events: 3, commit: true, wantBatches: []int{3}},
+		{events: 3},
+		{events: cdcMaxBufferedEvents, wantBatches: []int{cdcMaxBufferedEvents}},
+		{events: cdcMaxBufferedEvents + 2, commit: true, wantBatches: []int{cdcMaxBufferedEvents, 2}},
+	}
+
+	for _, test := range tests {
+		var batches []int
+		stream := newCDCStream(func(data []byte) error {
+			var events []cdcEvent
+			if err := json.Unmarshal(data, &events); err != nil {
+				t.Fatal(err)
+			}
+			batches = append(batches, len(events))
+			return nil
+		})
+		stream.relations[relation.RelationID] = relation
+
+		for i := 0; i < test.events; i++ {
+			if err := stream.addEvent(changeInsert, relation.RelationID, nil, tuple); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.commit {
+			if err := stream.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(batches, test.wantBatches) {
+			t.Errorf("%d events, commit %v: batches = %v, want %v", test.events, test.commit, batches, test.wantBatches)
+		}
+	}
+
+	stream := newCDCStream(func([]byte) error { return nil })
+	if err := stream.addEvent(changeInsert, 99, nil, nil); err == nil {
+		t.Error("addEvent accepted an unknown relation")
+	}
+
+	// A transaction that was not delivered must not be confirmed
+	stream = newCDCStream(func([]byte) error { return errors.New("destination down") })
+	stream.relations[relation.RelationID] = relation
+	if err := stream.addEvent(changeInsert, relation.RelationID, nil, tuple); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.flush(); err == nil {
+		t.Error("flush ignored the delivery error")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Operations of the change records emitted in change detection mode
+const (
+	changeInsert = "insert"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+// ChangeDetectionConfig makes a polled source emit the differences between consecutive
+// snapshots instead of the snapshots themselves. Records are matched on PrimaryKey and
+// the last snapshot is kept across restarts in Store, a file of the state directory.
+type ChangeDetectionConfig struct {
+	PrimaryKey []string `yaml:"PrimaryKey" json:"PrimaryKey"`
+	Store      string   `yaml:"Store,omitempty" json:"Store,omitempty"`
+}
+
+// changeRecord is a record that was inserted, updated or deleted since the last poll
+type changeRecord struct {
+	Op     string                 `json:"op"`
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+}
+
+// changeDetector holds the last snapshot of a source
+type changeDetector struct {
+	config   ChangeDetectionConfig
+	path     string
+	snapshot map[string]map[string]interface{}
+	mu       sync.Mutex
+}
+
+// Change detectors by source id and connector index
+var changeDetectors = make(map[string]*changeDetector)
+var changeDetectorsMu sync.Mutex
+
+// getChangeDetector returns the change detector of a connector, loading its last snapshot
+// the first time or when its configuration changed
+func getChangeDetector(sourceID int, connector int, config ChangeDetectionConfig) (*changeDetector, error) {
+	name := fmt.Sprintf("%d-%d", sourceID, connector)
+
+	changeDetectorsMu.Lock()
+	defer changeDetectorsMu.Unlock()
+
+	if detector, ok := changeDetectors[name]; ok && reflect.DeepEqual(detector.config, config) {
+		return detector, nil
+	}
+
+	path, err := storePath(config.Store, "snapshot", sourceID, connector, ".json")
+	if err != nil {
+		return nil, err
+	}
+	detector := &changeDetector{
+		config:   config,
+		path:     path,
+		snapshot: make(map[string]map[string]interface{}),
+	}
+
+	data, err := ioutil.ReadFile(detector.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &detector.snapshot); err != nil {
+			return nil, fmt.Errorf("cannot read snapshot %s: %v", detector.path, err)
+		}
+	}
+
+	changeDetectors[name] = detector
+	return detector, nil
+}
+
+// pendingSnapshot is a snapshot whose changes are being delivered. It only becomes the
+// reference of its change detector when commit is called, so that changes that could
+// not be delivered are found again by the next poll.
+type pendingSnapshot struct {
+	detector *changeDetector
+	snapshot map[string]map[string]interface{}
+}
+
+// detectChanges replaces a snapshot by the changes since the previous one when the
+// connector uses change detection, and returns false when nothing changed. The returned
+// snapshot is nil without change detection.
+func detectChanges(sourceID int, connector int, config Config, payload []byte) ([]byte, *pendingSnapshot, bool) {
+	if config.ChangeDetection == nil {
+		return payload, nil, true
+	}
+
+	detector, err := getChangeDetector(sourceID, connector, *config.ChangeDetection)
+	if err != nil {
+		log.Println("Failed to load snapshot:", err)
+		return nil, nil, false
+	}
+
+	records, _, err := decodeRecords(payload)
+	if err != nil {
+		log.Println("Error decoding snapshot:", err)
+		return nil, nil, false
+	}
+
+	changes, pending := detector.diff(records)
+	if len(changes) == 0 {
+		return nil, nil, false
+	}
+	data, err := json.Marshal(changes)
+	if err != nil {
+		log.Println("Error encoding changes:", err)
+		return nil, nil, false
+	}
+	return data, pending, true
+}
+
+// commit makes the snapshot the reference of its change detector, once its changes
+// were delivered
+func (p *pendingSnapshot) commit() {
+	if p == nil {
+		return
+	}
+	p.detector.mu.Lock()
+	defer p.detector.mu.Unlock()
+
+	p.detector.snapshot = p.snapshot
+	if err := p.detector.save(); err != nil {
+		log.Println("Failed to save snapshot:", err)
+	}
+}
+
+// diff compares a snapshot with the previous one and returns the changes together with
+// the snapshot to commit once they are delivered. Inserts and updates follow the order
+// of the snapshot, deletes come last by key.
+func (d *changeDetector) diff(records []map[string]interface{}) ([]changeRecord, *pendingSnapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := make(map[string]map[string]interface{}, len(records))
+	changes := make([]changeRecord, 0)
+	for _, record := range records {
+		key := recordKey(record, d.config.PrimaryKey)
+		if _, duplicate := current[key]; duplicate {
+			log.Println("Duplicate primary key in snapshot:", key)
+		}
+		current[key] = record
+
+		before, existed := d.snapshot[key]
+		switch {
+		case !existed:
+			changes = append(changes, changeRecord{Op: changeInsert, After: record})
+		case recordKey(before, nil) != recordKey(record, nil):
+			changes = append(changes, changeRecord{Op: changeUpdate, Before: before, After: record})
+		}
+	}
+
+	deleted := make([]string, 0)
+	for key := range d.snapshot {
+		if _, ok := current[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Strings(deleted)
+	for _, key := range deleted {
+		changes = append(changes, changeRecord{Op: changeDelete, Before: d.snapshot[key]})
+	}
+
+	return changes, &pendingSnapshot{detector: d, snapshot: current}
+}
+
+// save writes the snapshot to the store, replacing it atomically
+func (d *changeDetector) save() error {
+	data, err := json.Marshal(d.snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+		return err
+	}
+	temp := d.path + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, d.path)
+}
+
+// validateChangeDetection checks the primary key of a change detection connector
+func validateChangeDetection(errs *ValidationErrors, field string, config Config) {
+	if config.Type != "API" && config.Type != "DB" {
+		errs.add(field, "is only supported for API and DB sources")
+	}
+	if len(config.ChangeDetection.PrimaryKey) == 0 {
+		errs.add(field+".PrimaryKey", "is required")
+	}
+	for i, key := range config.ChangeDetection.PrimaryKey {
+		if _, err := parsePath(key); err != nil {
+			errs.add(fmt.Sprintf("%s.PrimaryKey[%d]", field, i), "%v", err)
+		}
+	}
+	if config.Dedup != nil {
+		errs.add(field, "cannot be used together with Dedup")
+	}
+	if config.WatermarkColumn != "" {
+		errs.add(field, "needs full snapshots and cannot be used together with WatermarkColumn")
+	}
+	if config.ChangeDetection.Store != "" {
+		if err := checkStorePath(config.ChangeDetection.Store); err != nil {
+			errs.add(field+".Store", "%v", err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestDetectChangesCommitsDeliveredSnapshots(t *testing.T) {
+	t.Setenv("CONFIG_DIR", t.TempDir())
+	config := Config{Type: "API", ChangeDetection: &ChangeDetectionConfig{PrimaryKey: []string{"id"}}}
+	payload := []byte(`[{"id": 1, "name": "Ada"}]`)
+
+	// A snapshot whose changes were not delivered is compared again by the next poll
+	if _, _, changed := detectChanges(1, 0, config, payload); !changed {
+		t.Fatal("first snapshot has no changes")
+	}
+	data, snapshot, changed := detectChanges(1, 0, config, payload)
+	if !changed || string(data) != `[{"op":"insert","before":null,"after":{"id":1,"name":"Ada"}}]` {
+		t.Fatalf("second poll = %s, %v, want the insert again", data, changed)
+	}
+
+	snapshot.commit()
+	if data, _, changed := detectChanges(1, 0, config, payload); changed {
+		t.Errorf("poll after commit = %s, want no changes", data)
+	}
+}
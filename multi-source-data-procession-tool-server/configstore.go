@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Directory holding the YAML configurations when CONFIG_DIR is not set
+const defaultConfigDir = "configs"
+
+// Configuration types that can be saved, loaded and deployed
+var knownConfigTypes = map[string]bool{
+	"sourceConfig":      true,
+	"destinationConfig": true,
+}
+
+// Config type names are plain identifiers, never paths
+var configTypePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// ConfigTypeError is returned with HTTP 400 when a request names an invalid config type
+type ConfigTypeError struct {
+	ConfigType string
+}
+
+func (e ConfigTypeError) Error() string {
+	return fmt.Sprintf("unknown config type %q", e.ConfigType)
+}
+
+// StatusCode makes GoFr respond with 400 Bad Request
+func (e ConfigTypeError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// configDir returns the directory where configuration files are stored
+func configDir() string {
+	if dir := os.Getenv("CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	return defaultConfigDir
+}
+
+// stateFilePath returns the default file holding the state of a connector, named after
+// its source and its position in the source, e.g. dedup-3-0.json for the first connector
+// of source 3, so that two connectors of a source never share a file
+func stateFilePath(kind string, sourceID int, connector int, extension string) string {
+	return filepath.Join(stateDir(), fmt.Sprintf("%s-%d-%d%s", kind, sourceID, connector, extension))
+}
+
+// stateDir returns the directory holding the state files of the connectors
+func stateDir() string {
+	return filepath.Join(configDir(), "state")
+}
+
+// storePath returns the file of a Store set in a configuration, which is relative to the
+// state directory, or the default state file of the connector when none is set
+func storePath(store string, kind string, sourceID int, connector int, extension string) (string, error) {
+	if store == "" {
+		return stateFilePath(kind, sourceID, connector, extension), nil
+	}
+	if err := checkStorePath(store); err != nil {
+		return "", fmt.Errorf("store %s %v", store, err)
+	}
+	return filepath.Join(stateDir(), store), nil
+}
+
+// checkStorePath rejects a Store that is absolute or climbs out of the state directory,
+// so that a configuration cannot make the server write anywhere else
+func checkStorePath(store string) error {
+	if filepath.IsAbs(store) || strings.HasPrefix(store, "/") || strings.HasPrefix(store, "\\") {
+		return errors.New("must be relative to the state directory")
+	}
+	for _, element := range strings.FieldsFunc(store, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element == ".." {
+			return errors.New("must not contain ..")
+		}
+	}
+	if filepath.Clean(store) == "." {
+		return errors.New("must name a file")
+	}
+	return nil
+}
+
+// configFilePath validates the config type and returns the path of its YAML file
+func configFilePath(configType string) (string, error) {
+	if !configTypePattern.MatchString(configType) || !knownConfigTypes[configType] {
+		return "", ConfigTypeError{ConfigType: configType}
+	}
+	return filepath.Join(configDir(), configType+".yaml"), nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCheckStorePath(t *testing.T) {
+	tests := []struct {
+		store   string
+		wantErr bool
+	}{
+		{store: "orders-dedup.json"},
+		{store: "api/orders.json"},
+		{store: "/etc/cron.d/job", wantErr: true},
+		{store: "../sourceConfig.yaml", wantErr: true},
+		{store: "api/../../main.go", wantErr: true},
+		{store: `..\outside.json`, wantErr: true},
+		{store: ".", wantErr: true},
+	}
+
+	for _, test := range tests {
+		if err := checkStorePath(test.store); (err != nil) != test.wantErr {
+			t.Errorf("checkStorePath(%q) error = %v, want error %v", test.store, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policies applied when a value cannot be converted to its KeyType
+const (
+	onErrorNull    = "NULL"
+	onErrorDefault = "DEFAULT"
+	onErrorReject  = "REJECT"
+)
+
+// Layouts tried for DATE values when no DateFormat is configured
+var defaultDateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// convertField coerces a source value to the KeyType of the output field and applies
+// the OnError policy when the conversion fails
+func convertField(value interface{}, output outputRuleStructure) (interface{}, error) {
+	if value == nil {
+		if strings.ToUpper(output.OnError) == onErrorDefault {
+			return output.Default, nil
+		}
+		return nil, nil
+	}
+
+	converted, err := convertValue(value, output.KeyType, output.DateFormat)
+	if err == nil {
+		return converted, nil
+	}
+	return fieldFailure(output, err)
+}
+
+// fieldFailure applies the OnError policy of an output field to a failed conversion
+func fieldFailure(output outputRuleStructure, err error) (interface{}, error) {
+	switch strings.ToUpper(output.OnError) {
+	case onErrorDefault:
+		return output.Default, nil
+	case onErrorReject:
+		return nil, fmt.Errorf("%s: %v", output.DisplayName, err)
+	default:
+		return nil, nil
+	}
+}
+
+// convertValue converts a single value to the given key type
+func convertValue(value interface{}, keyType string, dateFormat string) (interface{}, error) {
+	if strings.HasPrefix(keyType, "ARRAY_") && keyType != "ARRAY_STRUCT" {
+		elementType := strings.TrimPrefix(keyType, "ARRAY_")
+		items := toSlice(value)
+		converted := make([]interface{}, 0, len(items))
+		for index, item := range items {
+			element, err := convertValue(item, elementType, dateFormat)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", index, err)
+			}
+			converted = append(converted, element)
+		}
+		return converted, nil
+	}
+
+	switch keyType {
+	case "STRING":
+		return toString(value), nil
+	case "INT":
+		return toInt(value)
+	case "FLOAT":
+		return toFloat(value)
+	case "BOOL":
+		return toBool(value)
+	case "DATE":
+		return toDate(value, dateFormat)
+	default:
+		// STRUCT, ARRAY_STRUCT and unknown types keep the source value
+		return value, nil
+	}
+}
+
+// toSlice returns the elements of an array value. Strings holding a JSON array or a
+// comma separated list are split, any other value becomes a single element.
+func toSlice(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case string:
+		trimmed := strings.TrimSpace(v)
+		if trimmed == "" {
+			return []interface{}{}
+		}
+		if strings.HasPrefix(trimmed, "[") {
+			if decoded, err := decodeJSON([]byte(trimmed)); err == nil {
+				if items, ok := decoded.([]interface{}); ok {
+					return items
+				}
+			}
+		}
+		parts := strings.Split(trimmed, ",")
+		items := make([]interface{}, 0, len(parts))
+		for _, part := range parts {
+			items = append(items, strings.TrimSpace(part))
+		}
+		return items
+	default:
+		return []interface{}{value}
+	}
+}
+
+// toString formats a value as text. Numbers keep all their digits, objects and arrays
+// become JSON.
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
+
+// toInt converts a value to a 64-bit integer. Fractions and numbers outside the int64
+// range are errors, they are never truncated.
+func toInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		if v < -(1<<63) || v >= 1<<63 {
+			return 0, fmt.Errorf("%v is out of the INT range", v)
+		}
+		return int64(v), nil
+	case json.Number:
+		return toInt(v.String())
+	case string:
+		trimmed := strings.TrimSpace(v)
+		number, err := strconv.ParseInt(trimmed, 10, 64)
+		if err == nil {
+			return number, nil
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("%q is out of the INT range", v)
+		}
+		// Decimals and exponents such as 2.0 or 1e3 are read exactly
+		exact, ok := new(big.Rat).SetString(trimmed)
+		if !ok || strings.Contains(trimmed, "/") || !exact.IsInt() {
+			return 0, fmt.Errorf("%q is not an integer", v)
+		}
+		if !exact.Num().IsInt64() {
+			return 0, fmt.Errorf("%q is out of the INT range", v)
+		}
+		return exact.Num().Int64(), nil
+	default:
+		return 0, fmt.Errorf("cannot convert %T to INT", value)
+	}
+}
+
+// toFloat converts a value to a float64, the nearest one for numbers with more digits
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+		return number, nil
+	default:
+		return 0, fmt.Errorf("cannot convert %T to FLOAT", value)
+	}
+}
+
+// toBool converts a value to a boolean. Numbers must be 0 or 1.
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case float64, int64, json.Number:
+		number, err := toFloat(v)
+		if err != nil || (number != 0 && number != 1) {
+			return false, fmt.Errorf("%v is not a boolean", v)
+		}
+		return number == 1, nil
+	case string:
+		flag, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("%q is not a boolean", v)
+		}
+		return flag, nil
+	default:
+		return false, fmt.Errorf("cannot convert %T to BOOL", value)
+	}
+}
+
+// toDate parses a date with the configured layout, or the default layouts when none
+// is set. Numbers are read as Unix timestamps in seconds.
+func toDate(value interface{}, dateFormat string) (string, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case float64, int64, json.Number:
+		seconds, err := toFloat(v)
+		if err != nil {
+			return "", err
+		}
+		return time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339), nil
+	case string:
+		layouts := defaultDateLayouts
+		if dateFormat != "" {
+			layouts = []string{dateFormat}
+		}
+		for _, layout := range layouts {
+			if parsed, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return parsed.Format(time.RFC3339), nil
+			}
+		}
+		return "", fmt.Errorf("%q does not match the date format", v)
+	default:
+		return "", fmt.Errorf("cannot convert %T to DATE", value)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestConvertField(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		output  outputRuleStructure
+		want    interface{}
+		wantErr bool
+	}{
+		{value: 1.5, output: outputRuleStructure{KeyType: "STRING"}, want: "1.5"},
+		{value: int64(42), output: outputRuleStructure{KeyType: "STRING"}, want: "42"},
+		{value: " 42 ", output: outputRuleStructure{KeyType: "INT"}, want: int64(42)},
+		{value: 42.0, output: outputRuleStructure{KeyType: "INT"}, want: int64(42)},
+		{value: json.Number("9007199254740993"), output: outputRuleStructure{KeyType: "INT"}, want: int64(9007199254740993)},
+		{value: 4.2, output: outputRuleStructure{KeyType: "INT"}, want: nil},
+		{value: 1e19, output: outputRuleStructure{KeyType: "INT", OnError: "REJECT"}, wantErr: true},
+		{value: json.Number("12345678901234567890"), output: outputRuleStructure{KeyType: "INT", OnError: "REJECT"}, wantErr: true},
+		{value: json.Number("1e3"), output: outputRuleStructure{KeyType: "INT"}, want: int64(1000)},
+		{value: "9007199254740993.0", output: outputRuleStructure{KeyType: "INT"}, want: int64(9007199254740993)},
+		{value: "2.5", output: outputRuleStructure{KeyType: "INT", OnError: "REJECT"}, wantErr: true},
+		{value: "4/2", output: outputRuleStructure{KeyType: "INT", OnError: "REJECT"}, wantErr: true},
+		{value: int64(3), output: outputRuleStructure{KeyType: "FLOAT"}, want: 3.0},
+		{value: json.Number("0.25"), output: outputRuleStructure{KeyType: "FLOAT"}, want: 0.25},
+		{value: "true", output: outputRuleStructure{KeyType: "BOOL"}, want: true},
+		{value: int64(0), output: outputRuleStructure{KeyType: "BOOL"}, want: false},
+		{value: int64(2), output: outputRuleStructure{KeyType: "BOOL", OnError: "REJECT"}, wantErr: true},
+		{value: "2024-03-01", output: outputRuleStructure{KeyType: "DATE"}, want: "2024-03-01T00:00:00Z"},
+		{value: "01/03/2024", output: outputRuleStructure{KeyType: "DATE", DateFormat: "02/01/2006"}, want: "2024-03-01T00:00:00Z"},
+		{value: int64(0), output: outputRuleStructure{KeyType: "DATE"}, want: "1970-01-01T00:00:00Z"},
+		{value: "1, 2,3", output: outputRuleStructure{KeyType: "ARRAY_INT"}, want: []interface{}{int64(1), int64(2), int64(3)}},
+		{value: `[1.5, 2]`, output: outputRuleStructure{KeyType: "ARRAY_FLOAT"}, want: []interface{}{1.5, 2.0}},
+		{value: nil, output: outputRuleStructure{KeyType: "INT"}, want: nil},
+		{value: nil, output: outputRuleStructure{KeyType: "INT", OnError: "DEFAULT", Default: 0}, want: 0},
+		{value: "x", output: outputRuleStructure{KeyType: "INT", OnError: "DEFAULT", Default: -1}, want: -1},
+		{value: "x", output: outputRuleStructure{DisplayName: "id", KeyType: "INT", OnError: "REJECT"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := convertField(test.value, test.output)
+		if (err != nil) != test.wantErr {
+			t.Errorf("convertField(%#v, %s) error = %v, want error %v", test.value, test.output.KeyType, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("convertField(%#v, %s) = %#v, want %#v", test.value, test.output.KeyType, got, test.want)
+		}
+	}
+}
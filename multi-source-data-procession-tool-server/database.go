@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// Name of the query parameter holding the last watermark read from a DB source
+const lastWatermarkParam = "last_watermark"
+
+// dbDialect describes how to connect to a database type and how to write its queries
+type dbDialect struct {
+	driver      string
+	dsn         func(config Config) string
+	quote       func(identifier string) string
+	placeholder func(position int) string
+}
+
+// Supported values of DB_TYPE
+var dbDialects = map[string]dbDialect{
+	"mysql": {
+		driver: "mysql",
+		dsn: func(config Config) string {
+			mysqlConfig := mysql.NewConfig()
+			mysqlConfig.User = config.DBUser
+			mysqlConfig.Passwd = config.DBPassword
+			mysqlConfig.Net = "tcp"
+			mysqlConfig.Addr = net.JoinHostPort(config.DBHost, strconv.Itoa(config.DBPort))
+			mysqlConfig.DBName = config.DBName
+			mysqlConfig.ParseTime = true
+			mysqlConfig.TLSConfig = mysqlTLSModes[config.DBSSLMode]
+			return mysqlConfig.FormatDSN()
+		},
+		quote: func(identifier string) string {
+			return "`" + identifier + "`"
+		},
+		placeholder: func(int) string {
+			return "?"
+		},
+	},
+	"postgres": {
+		driver: "postgres",
+		dsn: func(config Config) string {
+			dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s", quoteDSNValue(config.DBHost), config.DBPort,
+				quoteDSNValue(config.DBUser), quoteDSNValue(config.DBPassword), quoteDSNValue(config.DBName))
+			if config.DBSSLMode != "" {
+				dsn += " sslmode=" + config.DBSSLMode
+			}
+			return dsn
+		},
+		quote: func(identifier string) string {
+			return `"` + identifier + `"`
+		},
+		placeholder: func(position int) string {
+			return "$" + strconv.Itoa(position)
+		},
+	},
+}
+
+// Values of DB_SSL_MODE, as named by PostgreSQL, and the TLS setting of the MySQL driver
+// each one maps to
+var mysqlTLSModes = map[string]string{
+	"":            "",
+	"disable":     "false",
+	"allow":       "preferred",
+	"prefer":      "preferred",
+	"require":     "skip-verify",
+	"verify-ca":   "true",
+	"verify-full": "true",
+}
+
+// Identifiers accepted for DB_TABLE_NAME and WatermarkColumn, quoted afterwards
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// dialectFor returns the dialect of a DB_TYPE
+func dialectFor(dbType string) (dbDialect, error) {
+	name := strings.ToLower(dbType)
+	if name == "postgresql" {
+		name = "postgres"
+	}
+	dialect, ok := dbDialects[name]
+	if !ok {
+		return dbDialect{}, fmt.Errorf("unsupported database type %q", dbType)
+	}
+	return dialect, nil
+}
+
+// quoteDSNValue quotes a value of a PostgreSQL connection string
+func quoteDSNValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// quoteIdentifier quotes a possibly schema qualified name such as "sales.customers".
+// Names that are not plain identifiers are rejected rather than escaped.
+func quoteIdentifier(dialect dbDialect, name string) (string, error) {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if !identifierPattern.MatchString(part) {
+			return "", fmt.Errorf("invalid identifier %q", name)
+		}
+		parts[i] = dialect.quote(part)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// buildSourceQuery returns the query reading a DB source and its arguments. Without a
+// custom Query the whole table is read, or its rows after the last watermark when a
+// WatermarkColumn is set.
+func buildSourceQuery(dialect dbDialect, config Config, params map[string]interface{}) (string, []interface{}, error) {
+	if config.Query != "" {
+		return bindNamedParams(dialect, config.Query, params)
+	}
+
+	table, err := quoteIdentifier(dialect, config.TableName)
+	if err != nil {
+		return "", nil, err
+	}
+	query := "SELECT * FROM " + table
+	if config.WatermarkColumn == "" {
+		return query, nil, nil
+	}
+
+	column, err := quoteIdentifier(dialect, config.WatermarkColumn)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, ok := params[lastWatermarkParam]; ok {
+		query += " WHERE " + column + " > :" + lastWatermarkParam
+	}
+	return bindNamedParams(dialect, query+" ORDER BY "+column, params)
+}
+
+// bindNamedParams replaces the named parameters of a query such as ":last_watermark" by
+// the placeholders of the dialect and returns their values in order
+func bindNamedParams(dialect dbDialect, query string, params map[string]interface{}) (string, []interface{}, error) {
+	var args []interface{}
+	bound, err := rewriteNamedParams(query, func(name string) (string, error) {
+		value, ok := params[name]
+		if !ok {
+			return "", fmt.Errorf("no value for query parameter :%s", name)
+		}
+		args = append(args, value)
+		return dialect.placeholder(len(args)), nil
+	})
+	return bound, args, err
+}
+
+// queryParamNames returns the named parameters used by a query
+func queryParamNames(query string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	_, err := rewriteNamedParams(query, func(name string) (string, error) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return "?", nil
+	})
+	return names, err
+}
+
+// rewriteNamedParams replaces every named parameter of a query with the result of
+// replace. Parameters inside quoted strings and identifiers, and PostgreSQL casts such
+// as "::date", are left alone.
+func rewriteNamedParams(query string, replace func(name string) (string, error)) (string, error) {
+	var builder strings.Builder
+	var quote byte
+	brackets := 0
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			// Line comments are copied up to the end of the line
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			builder.WriteString(query[i : i+end])
+			i += end - 1
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return "", errors.New("unterminated comment in query")
+			}
+			builder.WriteString(query[i : i+end+4])
+			i += end + 3
+			continue
+		case c == '[':
+			// Array subscripts and slices such as arr[lo:hi] hold no parameters
+			brackets++
+		case c == ']' && brackets > 0:
+			brackets--
+		case brackets > 0:
+		case c == ':' && i+1 < len(query) && query[i+1] == ':':
+			builder.WriteString("::")
+			i++
+			continue
+		case c == ':' && i+1 < len(query) && isParamStart(query[i+1]):
+			end := i + 1
+			for end < len(query) && isParamPart(query[end]) {
+				end++
+			}
+			placeholder, err := replace(query[i+1 : end])
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(placeholder)
+			i = end - 1
+			continue
+		}
+		builder.WriteByte(c)
+	}
+	if quote != 0 {
+		return "", errors.New("unterminated quote in query")
+	}
+	return builder.String(), nil
+}
+
+func isParamStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isParamPart(c byte) bool {
+	return isParamStart(c) || (c >= '0' && c <= '9')
+}
+
+// sourceQueryParams returns the parameters of the query of a DB source: its QueryParams
+// and the last watermark, or InitialWatermark before the first read
+func sourceQueryParams(sourceID int, connector int, config Config) map[string]interface{} {
+	params := make(map[string]interface{}, len(config.QueryParams)+1)
+	for name, value := range config.QueryParams {
+		params[name] = value
+	}
+	if config.WatermarkColumn == "" {
+		return params
+	}
+	if watermark, ok := loadWatermark(sourceID, connector); ok {
+		params[lastWatermarkParam] = watermarkArg(watermark)
+	} else if config.InitialWatermark != nil {
+		params[lastWatermarkParam] = config.InitialWatermark
+	}
+	return params
+}
+
+// watermarkArg passes the timestamps stored as RFC 3339 strings as times, which every
+// driver compares correctly with its date columns
+func watermarkArg(watermark interface{}) interface{} {
+	switch value := watermark.(type) {
+	case string:
+		if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return parsed
+		}
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+		if number, err := value.Float64(); err == nil {
+			return number
+		}
+	}
+	return watermark
+}
+
+// compareWatermarks compares two watermark values, as times when both are timestamps
+// and exactly when both are numbers
+func compareWatermarks(a interface{}, b interface{}) int {
+	left, leftIsTime := watermarkArg(a).(time.Time)
+	right, rightIsTime := watermarkArg(b).(time.Time)
+	if leftIsTime && rightIsTime {
+		return left.Compare(right)
+	}
+	if left, ok := exactNumber(a); ok {
+		if right, ok := exactNumber(b); ok {
+			return left.Cmp(right)
+		}
+	}
+	return compareValues(a, b)
+}
+
+// exactNumber returns a numeric watermark as a big.Rat, so that large integers and
+// decimals are compared without the rounding of float64
+func exactNumber(value interface{}) (*big.Rat, bool) {
+	switch v := value.(type) {
+	case int:
+		return new(big.Rat).SetInt64(int64(v)), true
+	case int64:
+		return new(big.Rat).SetInt64(v), true
+	case uint64:
+		return new(big.Rat).SetUint64(v), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(v), true
+	case json.Number:
+		return new(big.Rat).SetString(v.String())
+	}
+	return nil, false
+}
+
+// watermarkKey returns the name of a possibly qualified WatermarkColumn such as
+// "t.updated_at" in the rows read, which are keyed by the bare column name
+func watermarkKey(column string) string {
+	return column[strings.LastIndex(column, ".")+1:]
+}
+
+// Serialises the reads and writes of the watermarks
+var watermarkMu sync.Mutex
+
+// watermarkPath returns the file holding the watermark of a DB connector
+func watermarkPath(sourceID int, connector int) string {
+	return stateFilePath("watermark", sourceID, connector, ".json")
+}
+
+// loadWatermark returns the last watermark read by a DB connector
+func loadWatermark(sourceID int, connector int) (interface{}, bool) {
+	watermarkMu.Lock()
+	defer watermarkMu.Unlock()
+
+	data, err := ioutil.ReadFile(watermarkPath(sourceID, connector))
+	if err != nil {
+		return nil, false
+	}
+	// Large integer watermarks would lose their precision as float64
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var watermark interface{}
+	if err := decoder.Decode(&watermark); err != nil || watermark == nil {
+		return nil, false
+	}
+	return watermark, true
+}
+
+// saveWatermark stores the highest value of the watermark column among the rows read
+func saveWatermark(sourceID int, connector int, column string, rows []map[string]interface{}) error {
+	var highest interface{}
+	key := watermarkKey(column)
+	for _, row := range rows {
+		value, ok := row[key]
+		if !ok || value == nil {
+			continue
+		}
+		if highest == nil || compareWatermarks(value, highest) > 0 {
+			highest = value
+		}
+	}
+	if highest == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(highest)
+	if err != nil {
+		return err
+	}
+
+	watermarkMu.Lock()
+	defer watermarkMu.Unlock()
+	path := watermarkPath(sourceID, connector)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// validateDatabase checks the dialect, identifiers and query of a DB connector
+func validateDatabase(errs *ValidationErrors, field string, config Config) {
+	dialect, err := dialectFor(config.DBType)
+	if err != nil {
+		errs.add(field+".DB_TYPE", "%v", err)
+		return
+	}
+
+	if _, ok := mysqlTLSModes[config.DBSSLMode]; !ok {
+		errs.add(field+".DB_SSL_MODE", "must be disable, allow, prefer, require, verify-ca or verify-full")
+	}
+	if config.TableName != "" {
+		if _, err := quoteIdentifier(dialect, config.TableName); err != nil {
+			errs.add(field+".DB_TABLE_NAME", "%v", err)
+		}
+	}
+	if config.WatermarkColumn != "" {
+		if _, err := quoteIdentifier(dialect, config.WatermarkColumn); err != nil {
+			errs.add(field+".WatermarkColumn", "%v", err)
+		}
+	}
+
+	if config.Query == "" {
+		requireField(errs, field+".DB_TABLE_NAME", config.TableName)
+		return
+	}
+	names, err := queryParamNames(config.Query)
+	if err != nil {
+		errs.add(field+".Query", "%v", err)
+		return
+	}
+	for _, name := range names {
+		if name == lastWatermarkParam {
+			if config.WatermarkColumn == "" {
+				errs.add(field+".Query", ":%s requires a WatermarkColumn", name)
+			} else if config.InitialWatermark == nil {
+				errs.add(field+".InitialWatermark", "is required when the query uses :%s", name)
+			}
+			continue
+		}
+		if _, ok := config.QueryParams[name]; !ok {
+			errs.add(field+".QueryParams", "no value for query parameter :%s", name)
+		}
+	}
+}
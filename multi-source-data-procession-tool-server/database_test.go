@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestRewriteNamedParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "SELECT * FROM t WHERE id > :last_id AND kind = :kind", want: "SELECT * FROM t WHERE id > $1 AND kind = $2"},
+		{query: "SELECT created::date FROM t WHERE id > :id::int", want: "SELECT created::date FROM t WHERE id > $1::int"},
+		{query: "SELECT ':skip', \":skip\", `:skip` FROM t WHERE id = :id", want: "SELECT ':skip', \":skip\", `:skip` FROM t WHERE id = $1"},
+		{query: "SELECT 1 -- at :skip\nWHERE id = :id", want: "SELECT 1 -- at :skip\nWHERE id = $1"},
+		{query: "SELECT :id -- :skip", want: "SELECT $1 -- :skip"},
+		{query: "SELECT /* :skip\n:skip */ :id", want: "SELECT /* :skip\n:skip */ $1"},
+		{query: "SELECT tags[lo:hi] FROM t WHERE id = :id", want: "SELECT tags[lo:hi] FROM t WHERE id = $1"},
+		{query: "SELECT 1 WHERE x = :1", want: "SELECT 1 WHERE x = :1"},
+		{query: "SELECT :id /* :skip", wantErr: true},
+		{query: "SELECT ':id", wantErr: true},
+		{query: "SELECT :skip", wantErr: true},
+	}
+
+	for _, test := range tests {
+		count := 0
+		got, err := rewriteNamedParams(test.query, func(name string) (string, error) {
+			if name == "skip" {
+				return "", fmt.Errorf("unknown parameter %q", name)
+			}
+			count++
+			return fmt.Sprintf("$%d", count), nil
+		})
+		if (err != nil) != test.wantErr {
+			t.Errorf("rewriteNamedParams(%q) error = %v, want error %v", test.query, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("rewriteNamedParams(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestCompareWatermarks(t *testing.T) {
+	tests := []struct {
+		a, b interface{}
+		want int
+	}{
+		{a: int64(9007199254740993), b: int64(9007199254740992), want: 1},
+		{a: json.Number("9007199254740993"), b: int64(9007199254740992), want: 1},
+		{a: json.Number("12345678901234567.01"), b: json.Number("12345678901234567.001"), want: 1},
+		{a: json.Number("1.50"), b: 1.5, want: 0},
+		{a: uint64(18446744073709551615), b: json.Number("18446744073709551614"), want: 1},
+		{a: "2024-01-02T00:00:00Z", b: "2024-01-01T23:00:00-02:00", want: -1},
+		{a: "b", b: "a", want: 1},
+	}
+
+	for _, test := range tests {
+		if got := compareWatermarks(test.a, test.b); got != test.want {
+			t.Errorf("compareWatermarks(%v, %v) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSaveWatermarkQualifiedColumn(t *testing.T) {
+	t.Setenv("CONFIG_DIR", t.TempDir())
+
+	rows := []map[string]interface{}{{"updated_at": int64(3)}, {"updated_at": int64(7)}, {"updated_at": nil}}
+	if err := saveWatermark(1, 0, "t.updated_at", rows); err != nil {
+		t.Fatalf("saveWatermark: %v", err)
+	}
+	watermark, ok := loadWatermark(1, 0)
+	if !ok || watermark != json.Number("7") {
+		t.Errorf("watermark = %v, want 7", watermark)
+	}
+}
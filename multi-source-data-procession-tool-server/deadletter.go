@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// deadLetterRecord is the envelope sent to a dead letter destination. Record holds the
+// rejected record, or its JSON text when the destination uses a schema registry.
+type deadLetterRecord struct {
+	Source    int         `json:"source"`
+	Reason    string      `json:"reason"`
+	Record    interface{} `json:"record"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// deadLetterOutputFormat is the output format the schema of a registered dead letter
+// destination is generated from
+var deadLetterOutputFormat = []outputRuleStructure{
+	{DisplayName: "source", KeyType: "INT"},
+	{DisplayName: "reason", KeyType: "STRING"},
+	{DisplayName: "record", KeyType: "STRING"},
+	{DisplayName: "timestamp", KeyType: "DATE"},
+}
+
+// sendToDeadLetter forwards a rejected record to the dead letter destination of its
+// source, or logs it when the source has none
+func sendToDeadLetter(sourceID int, record map[string]interface{}, reason string) {
+	config, ok := getDestinationConfig(sourceID)
+	if !ok || config.DeadLetter == nil {
+		log.Printf("Rejected record from source %d: %s", sourceID, reason)
+		return
+	}
+
+	envelope := deadLetterRecord{
+		Source:    sourceID,
+		Reason:    reason,
+		Record:    record,
+		Timestamp: time.Now().UTC(),
+	}
+	if config.DeadLetter.SchemaRegistry != nil {
+		// Rejected records have no fixed shape, the registered schema keeps them as text
+		recordData, err := json.Marshal(record)
+		if err != nil {
+			log.Println("Error marshalling dead letter record:", err)
+			return
+		}
+		envelope.Record = string(recordData)
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		log.Println("Error marshalling dead letter record:", err)
+		return
+	}
+	if err := publishToDestination(*config.DeadLetter, "", data); err != nil {
+		log.Printf("Failed to send rejected record from source %d: %v", sourceID, err)
+	}
+}
+
+// recordRejections collects the reasons the records of a batch were rejected, so that a
+// source record failing for several destinations reaches the dead letter destination
+// once with all of its reasons
+type recordRejections struct {
+	records []map[string]interface{}
+	reasons map[int][]string
+	order   []int
+	other   []recordError
+}
+
+// newRecordRejections starts collecting the rejections of a batch of source records
+func newRecordRejections(records []map[string]interface{}) *recordRejections {
+	return &recordRejections{records: records, reasons: make(map[int][]string)}
+}
+
+// add records the error of the source record at origin. Errors without an origin, such
+// as those of aggregates, are kept as they are.
+func (r *recordRejections) add(origin int, recordErr recordError, prefix string) {
+	if origin < 0 || origin >= len(r.records) {
+		recordErr.Error = prefix + recordErr.Error
+		r.other = append(r.other, recordErr)
+		return
+	}
+	if _, exists := r.reasons[origin]; !exists {
+		r.order = append(r.order, origin)
+	}
+	r.reasons[origin] = append(r.reasons[origin], prefix+recordErr.Error)
+}
+
+// send forwards every rejected record once to the dead letter destination
+func (r *recordRejections) send(sourceID int) {
+	for _, origin := range r.order {
+		sendToDeadLetter(sourceID, r.records[origin], strings.Join(r.reasons[origin], "; "))
+	}
+	for _, recordErr := range r.other {
+		sendToDeadLetter(sourceID, recordErr.Record, recordErr.Error)
+	}
+}
+
+// publishDataToFile appends data as a single line to a file
+func publishDataToFile(filePath string, data []byte) error {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error opening output file:", err)
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		log.Println("Error writing output file:", err)
+	}
+	return err
+}
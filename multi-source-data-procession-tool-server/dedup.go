@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DedupConfig drops the records a polled source already delivered. Records are
+// identified by Keys, or by their whole content when Keys is empty, and a record whose
+// key was seen is only sent again when its content changed or its entry is older than
+// TTL. Seen records are kept across restarts in Store, a file of the state directory.
+type DedupConfig struct {
+	Keys  []string `yaml:"Keys,omitempty" json:"Keys,omitempty"`
+	TTL   string   `yaml:"TTL,omitempty" json:"TTL,omitempty"`
+	Store string   `yaml:"Store,omitempty" json:"Store,omitempty"`
+}
+
+// dedupEntry is the last content hash seen for a key
+type dedupEntry struct {
+	Hash string    `json:"hash"`
+	Seen time.Time `json:"seen"`
+}
+
+// dedupPending is the entry of a record kept by filter, remembered once it is delivered
+type dedupPending struct {
+	key   string
+	entry dedupEntry
+}
+
+// deduplicator remembers the records of one source. dirty is set when entries changed
+// since the store was last written.
+type deduplicator struct {
+	keys    []string
+	ttl     time.Duration
+	path    string
+	entries map[string]dedupEntry
+	dirty   bool
+	mu      sync.Mutex
+}
+
+// newDeduplicator loads the store of a connector, nil when the connector has no Dedup
+func newDeduplicator(sourceID int, connector int, config Config) (*deduplicator, error) {
+	if config.Dedup == nil {
+		return nil, nil
+	}
+
+	path, err := storePath(config.Dedup.Store, "dedup", sourceID, connector, ".json")
+	if err != nil {
+		return nil, err
+	}
+	d := &deduplicator{
+		keys:    config.Dedup.Keys,
+		path:    path,
+		entries: make(map[string]dedupEntry),
+	}
+	if config.Dedup.TTL != "" {
+		ttl, err := parseDuration(config.Dedup.TTL)
+		if err != nil {
+			return nil, err
+		}
+		d.ttl = ttl
+	}
+	data, err := ioutil.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &d.entries); err != nil {
+		return nil, fmt.Errorf("cannot read dedup store %s: %v", d.path, err)
+	}
+	return d, nil
+}
+
+// filter returns the payload reduced to its new or changed records, and false when
+// nothing is left to send. The kept records are only remembered once commit is called
+// with the returned entries, which follow the order of the kept records. Payloads that
+// cannot be decoded are passed on unchanged.
+func (d *deduplicator) filter(payload []byte) ([]byte, []dedupPending, bool) {
+	records, single, err := decodeRecords(payload)
+	if err != nil {
+		return payload, nil, true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	d.expire(now)
+
+	kept := make([]map[string]interface{}, 0, len(records))
+	pending := make([]dedupPending, 0, len(records))
+	keptHashes := make(map[string]string)
+	for _, record := range records {
+		hash := contentHash(record)
+		key := hash
+		if len(d.keys) > 0 {
+			key = recordKey(record, d.keys)
+		}
+
+		if entry, seen := d.entries[key]; seen && entry.Hash == hash {
+			continue
+		}
+		if keptHash, seen := keptHashes[key]; seen && keptHash == hash {
+			continue
+		}
+		keptHashes[key] = hash
+		pending = append(pending, dedupPending{key: key, entry: dedupEntry{Hash: hash, Seen: now}})
+		kept = append(kept, record)
+	}
+
+	if len(kept) == 0 {
+		d.saveIfDirty()
+		return nil, nil, false
+	}
+	var data []byte
+	if single {
+		data, err = json.Marshal(kept[0])
+	} else {
+		data, err = json.Marshal(kept)
+	}
+	return data, pending, err == nil
+}
+
+// commit remembers the entries returned by filter, except those of the records at the
+// positions in undelivered, and writes the store
+func (d *deduplicator) commit(pending []dedupPending, undelivered map[int]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for position, record := range pending {
+		if undelivered[position] {
+			continue
+		}
+		d.entries[record.key] = record.entry
+		d.dirty = true
+	}
+	d.saveIfDirty()
+}
+
+// expire forgets the entries older than the TTL
+func (d *deduplicator) expire(now time.Time) {
+	if d.ttl <= 0 {
+		return
+	}
+	for key, entry := range d.entries {
+		if now.Sub(entry.Seen) >= d.ttl {
+			delete(d.entries, key)
+			d.dirty = true
+		}
+	}
+}
+
+// saveIfDirty writes the store when its entries changed, so that polls returning only
+// known records do not rewrite it
+func (d *deduplicator) saveIfDirty() {
+	if !d.dirty {
+		return
+	}
+	if err := d.save(); err != nil {
+		log.Println("Failed to save dedup store:", err)
+		return
+	}
+	d.dirty = false
+}
+
+// save writes the entries to the store, replacing it atomically
+func (d *deduplicator) save() error {
+	data, err := json.Marshal(d.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+		return err
+	}
+	temp := d.path + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, d.path)
+}
+
+// contentHash returns the SHA-256 of a record, which does not depend on key order
+func contentHash(record map[string]interface{}) string {
+	sum := sha256.Sum256([]byte(recordKey(record, nil)))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateDedup checks the keys and TTL of a dedup stage, which only polled API sources
+// run
+func validateDedup(errs *ValidationErrors, field string, config Config) {
+	dedup := *config.Dedup
+	if config.Type != "API" {
+		errs.add(field, "is only supported for API sources")
+	}
+	for i, key := range dedup.Keys {
+		if _, err := parsePath(key); err != nil {
+			errs.add(fmt.Sprintf("%s.Keys[%d]", field, i), "%v", err)
+		}
+	}
+	if dedup.TTL != "" {
+		ttl, err := parseDuration(dedup.TTL)
+		if err != nil {
+			errs.add(field+".TTL", "%v", err)
+		} else if ttl <= 0 {
+			errs.add(field+".TTL", "must be greater than zero")
+		}
+	}
+	if dedup.Store != "" {
+		if err := checkStorePath(dedup.Store); err != nil {
+			errs.add(field+".Store", "%v", err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDedupCommitsDeliveredRecords(t *testing.T) {
+	t.Setenv("CONFIG_DIR", t.TempDir())
+	dedup, err := newDeduplicator(1, 0, Config{Type: "API", Dedup: &DedupConfig{Keys: []string{"id"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(`[{"id": 1}, {"id": 2}, {"id": 3}]`)
+	data, pending, changed := dedup.filter(payload)
+	if !changed || len(pending) != 3 {
+		t.Fatalf("filter kept %d records, want 3", len(pending))
+	}
+	// The record at position 1 was rejected by its transformation
+	dedup.commit(pending, map[int]bool{1: true})
+
+	data, _, changed = dedup.filter(payload)
+	var records []map[string]interface{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{{"id": 2.0}}
+	if !changed || !reflect.DeepEqual(records, want) {
+		t.Errorf("second poll sends %v, want %v", records, want)
+	}
+}
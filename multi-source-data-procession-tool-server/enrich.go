@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Lookup modes of a LOOKUP step reading another source
+const (
+	lookupModeSnapshot = "SNAPSHOT"
+	lookupModeUpsert   = "UPSERT"
+)
+
+// lookupIndex keeps the latest records of a source by the value of one field
+type lookupIndex struct {
+	field   string
+	upsert  bool
+	records map[string]map[string]interface{}
+}
+
+// Lookup indexes of every source used by a LOOKUP step, keyed by source id and then by
+// field and mode
+var lookupIndexes = make(map[int]map[string]*lookupIndex)
+var lookupMu sync.RWMutex
+
+// lookupIndexName identifies an index of a source
+func lookupIndexName(field string, mode string) string {
+	return field + "|" + strings.ToUpper(mode)
+}
+
+// lookupField is the field of the other source matched against Field
+func lookupField(step TransformationStep) string {
+	if step.On != "" {
+		return step.On
+	}
+	return step.Field
+}
+
+// registerLookupIndexes creates the indexes needed by the LOOKUP steps of the deployed
+// destinations. Indexes that are still used keep their records.
+func registerLookupIndexes(configs map[int]DataSource) {
+	needed := make(map[int]map[string]*lookupIndex)
+	addSteps := func(steps []TransformationStep) {
+		for _, step := range steps {
+			if strings.ToUpper(step.Type) != stepLookup || step.FromSource == 0 {
+				continue
+			}
+			if needed[step.FromSource] == nil {
+				needed[step.FromSource] = make(map[string]*lookupIndex)
+			}
+			name := lookupIndexName(lookupField(step), step.LookupMode)
+			needed[step.FromSource][name] = &lookupIndex{
+				field:   lookupField(step),
+				upsert:  strings.ToUpper(step.LookupMode) == lookupModeUpsert,
+				records: make(map[string]map[string]interface{}),
+			}
+		}
+	}
+	for _, dataSource := range configs {
+		addSteps(dataSource.TransformationConfig.Steps)
+		for _, cfg := range dataSource.Config {
+			if cfg.TransformationConfig != nil {
+				addSteps(cfg.TransformationConfig.Steps)
+			}
+		}
+	}
+
+	lookupMu.Lock()
+	defer lookupMu.Unlock()
+	for sourceID, indexes := range needed {
+		for name := range indexes {
+			if existing, ok := lookupIndexes[sourceID][name]; ok {
+				indexes[name] = existing
+			}
+		}
+	}
+	lookupIndexes = needed
+}
+
+// updateLookupIndexes stores the records read from a source in its indexes, before
+// change detection or dedup drop the unchanged ones. Snapshot indexes are replaced by
+// every batch, upsert indexes are updated.
+func updateLookupIndexes(sourceID int, records []map[string]interface{}) {
+	lookupMu.Lock()
+	defer lookupMu.Unlock()
+
+	for _, index := range lookupIndexes[sourceID] {
+		if !index.upsert {
+			index.records = make(map[string]map[string]interface{}, len(records))
+		}
+		for _, record := range records {
+			value, exists := ruleValue(record, index.field)
+			if !exists || value == nil {
+				continue
+			}
+			index.records[toString(value)] = record
+		}
+	}
+}
+
+// findLookupRecord returns the record of another source matching a value
+func findLookupRecord(sourceID int, field string, mode string, value interface{}) (map[string]interface{}, bool) {
+	lookupMu.RLock()
+	defer lookupMu.RUnlock()
+
+	index, ok := lookupIndexes[sourceID][lookupIndexName(field, mode)]
+	if !ok {
+		return nil, false
+	}
+	record, found := index.records[toString(value)]
+	return record, found
+}
+
+// enrichRecord adds the fields of the matching record of another source. The fields are
+// merged into the record, or nested under Target when it is set.
+func enrichRecord(record map[string]interface{}, step TransformationStep) {
+	value, exists := ruleValue(record, step.Field)
+	if !exists || value == nil {
+		return
+	}
+	match, found := findLookupRecord(step.FromSource, lookupField(step), step.LookupMode, value)
+	if !found {
+		return
+	}
+
+	selected := match
+	if len(step.Fields) > 0 {
+		selected = make(map[string]interface{}, len(step.Fields))
+		for _, field := range step.Fields {
+			if item, ok := ruleValue(match, field); ok {
+				selected[field] = item
+			}
+		}
+	}
+
+	if step.Target != "" {
+		record[step.Target] = copyRecord(selected)
+		return
+	}
+	for key, item := range selected {
+		record[key] = item
+	}
+}
+
+// validateLookup checks a LOOKUP step reading a static table or another source
+func validateLookup(errs *ValidationErrors, field string, step TransformationStep) {
+	requireField(errs, field+".Field", step.Field)
+	if len(step.Table) == 0 && step.FromSource == 0 {
+		errs.add(field+".Table", "Table or FromSource is required for LOOKUP")
+	}
+	switch strings.ToUpper(step.LookupMode) {
+	case "", lookupModeSnapshot, lookupModeUpsert:
+	default:
+		errs.add(field+".LookupMode", "must be %s or %s", lookupModeSnapshot, lookupModeUpsert)
+	}
+	if step.FromSource != 0 && len(step.Table) > 0 {
+		errs.add(field+".FromSource", "cannot be used together with Table")
+	}
+}
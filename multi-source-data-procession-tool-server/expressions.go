@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/PaesslerAG/gval"
+)
+
+// expressionLanguage is the gval language used for filter rules and field rules. It is
+// the full gval language extended with the built in functions below.
+var expressionLanguage = gval.NewLanguage(
+	gval.Full(),
+	gval.Function("concat", func(args ...interface{}) (interface{}, error) {
+		var builder strings.Builder
+		for _, arg := range args {
+			if arg != nil {
+				builder.WriteString(toString(arg))
+			}
+		}
+		return builder.String(), nil
+	}),
+	gval.Function("upper", stringFunction(strings.ToUpper)),
+	gval.Function("lower", stringFunction(strings.ToLower)),
+	gval.Function("trim", stringFunction(strings.TrimSpace)),
+	gval.Function("substr", func(args ...interface{}) (interface{}, error) {
+		if len(args) < 2 || len(args) > 3 {
+			return nil, fmt.Errorf("substr(text, start[, length]) expects 2 or 3 arguments")
+		}
+		text := []rune(toString(args[0]))
+		start, err := toInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		start = int64(math.Max(0, math.Min(float64(start), float64(len(text)))))
+		end := int64(len(text))
+		if len(args) == 3 {
+			length, err := toInt(args[2])
+			if err != nil {
+				return nil, err
+			}
+			end = int64(math.Min(float64(start+length), float64(len(text))))
+		}
+		if end < start {
+			end = start
+		}
+		return string(text[start:end]), nil
+	}),
+	gval.Function("replace", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 3 {
+			return nil, fmt.Errorf("replace(text, old, new) expects 3 arguments")
+		}
+		return strings.ReplaceAll(toString(args[0]), toString(args[1]), toString(args[2])), nil
+	}),
+	gval.Function("contains", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("contains(text, part) expects 2 arguments")
+		}
+		return strings.Contains(toString(args[0]), toString(args[1])), nil
+	}),
+	gval.Function("split", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("split(text, separator) expects 2 arguments")
+		}
+		parts := strings.Split(toString(args[0]), toString(args[1]))
+		items := make([]interface{}, 0, len(parts))
+		for _, part := range parts {
+			items = append(items, part)
+		}
+		return items, nil
+	}),
+	gval.Function("length", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("length(value) expects 1 argument")
+		}
+		switch v := args[0].(type) {
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return 0.0, nil
+		default:
+			return float64(len([]rune(toString(v)))), nil
+		}
+	}),
+	gval.Function("coalesce", func(args ...interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil && arg != "" {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}),
+	gval.Function("round", func(args ...interface{}) (interface{}, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("round(number[, digits]) expects 1 or 2 arguments")
+		}
+		number, err := toFloat(args[0])
+		if err != nil {
+			return nil, err
+		}
+		var digits int64
+		if len(args) == 2 {
+			if digits, err = toInt(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		scale := math.Pow(10, float64(digits))
+		return math.Round(number*scale) / scale, nil
+	}),
+	gval.Function("abs", func(value interface{}) (interface{}, error) {
+		number, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return math.Abs(number), nil
+	}),
+	gval.Function("toInt", func(value interface{}) (interface{}, error) {
+		return convertValue(value, "INT", "")
+	}),
+	gval.Function("toFloat", func(value interface{}) (interface{}, error) {
+		return convertValue(value, "FLOAT", "")
+	}),
+	gval.Function("toString", func(value interface{}) string {
+		return toString(value)
+	}),
+	gval.Function("mask", func(args ...interface{}) (interface{}, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("mask(value[, keep]) expects 1 or 2 arguments")
+		}
+		keep := int64(defaultMaskKeep)
+		if len(args) == 2 {
+			var err error
+			if keep, err = toInt(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return partialMask(toString(args[0]), int(keep)), nil
+	}),
+	gval.Function("sha256", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("sha256(value, key) expects 2 arguments")
+		}
+		key := toString(args[1])
+		if key == "" {
+			return nil, fmt.Errorf("sha256(value, key) requires a non empty key")
+		}
+		return keyedHash(toString(args[0]), key), nil
+	}),
+	gval.Function("tokenize", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("tokenize(value, salt) expects 2 arguments")
+		}
+		return tokenize(toString(args[0]), toString(args[1])), nil
+	}),
+	gval.Function("now", func() string {
+		return time.Now().UTC().Format(time.RFC3339)
+	}),
+	gval.Function("parseDate", func(args ...interface{}) (interface{}, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("parseDate(value[, layout]) expects 1 or 2 arguments")
+		}
+		layout := ""
+		if len(args) == 2 {
+			layout = toString(args[1])
+		}
+		return toDate(args[0], layout)
+	}),
+	gval.Function("formatDate", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("formatDate(date, layout) expects 2 arguments")
+		}
+		date, err := expressionTime(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return date.Format(toString(args[1])), nil
+	}),
+	gval.Function("dateDiffDays", func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("dateDiffDays(from, to) expects 2 arguments")
+		}
+		from, err := expressionTime(args[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := expressionTime(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return math.Floor(to.Sub(from).Hours() / 24), nil
+	}),
+)
+
+// Compiled expressions keyed by their text
+var compiledExpressions = newBoundedCache(compiledCacheSize)
+
+// compileExpression parses an expression once and returns the cached evaluable afterwards
+func compileExpression(expression string) (gval.Evaluable, error) {
+	if cached, ok := compiledExpressions.get(expression); ok {
+		return cached.(gval.Evaluable), nil
+	}
+
+	evaluable, err := expressionLanguage.NewEvaluable(expression)
+	if err != nil {
+		return nil, err
+	}
+	compiledExpressions.add(expression, evaluable)
+	return evaluable, nil
+}
+
+// evaluateExpression evaluates an expression against a record
+func evaluateExpression(expression string, record map[string]interface{}) (interface{}, error) {
+	evaluable, err := compileExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	return evaluable(context.Background(), record)
+}
+
+// stringFunction adapts a string transformation to a gval function
+func stringFunction(transform func(string) string) func(interface{}) string {
+	return func(value interface{}) string {
+		if value == nil {
+			return ""
+		}
+		return transform(toString(value))
+	}
+}
+
+// expressionTime parses the dates handled by the date functions
+func expressionTime(value interface{}) (time.Time, error) {
+	text, err := toDate(value, "")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, text)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Filter types accepted in TransformationConfig
+const (
+	filterTypeGval        = "GVAL"
+	filterTypeDeclarative = "DECLARATIVE"
+)
+
+// Operators accepted in declarative rules
+var supportedRuleOperators = map[string]bool{
+	"==": true, "=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true,
+	"contains": true, "in": true, "not_in": true, "regex": true,
+	"exists": true, "not_exists": true, "between": true,
+}
+
+// Compiled regex rules keyed by their pattern
+var rulePatterns = newBoundedCache(compiledCacheSize)
+
+// recordFilter decides whether a record is kept
+type recordFilter func(record map[string]interface{}) (bool, error)
+
+// newRecordFilter builds the filter of a transformation. RuleType is a gval expression
+// unless FilterType is DECLARATIVE, in which case it is read by evaluateComplexRule.
+// A structured Filter group is always declarative and must match as well.
+func newRecordFilter(transformation finalOutputDataJSON) (recordFilter, error) {
+	var filters []recordFilter
+
+	if transformation.RuleType != "" {
+		switch strings.ToUpper(transformation.FilterType) {
+		case "", filterTypeGval:
+			rule, err := compileExpression(transformation.RuleType)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, func(record map[string]interface{}) (bool, error) {
+				value, err := rule(context.Background(), record)
+				if err != nil {
+					return false, err
+				}
+				keep, ok := value.(bool)
+				if !ok {
+					return false, fmt.Errorf("rule returned %v instead of a boolean", value)
+				}
+				return keep, nil
+			})
+		case filterTypeDeclarative:
+			if err := validateComplexRule(transformation.RuleType); err != nil {
+				return nil, err
+			}
+			filters = append(filters, func(record map[string]interface{}) (bool, error) {
+				return evaluateComplexRule(record, transformation.RuleType)
+			})
+		default:
+			return nil, fmt.Errorf("unknown filter type %q", transformation.FilterType)
+		}
+	}
+
+	if transformation.Filter != nil {
+		group := *transformation.Filter
+		filters = append(filters, func(record map[string]interface{}) (bool, error) {
+			return evaluateFilterGroup(record, group)
+		})
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return func(record map[string]interface{}) (bool, error) {
+		for _, filter := range filters {
+			keep, err := filter(record)
+			if err != nil || !keep {
+				return false, err
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+// evaluateFilterGroup evaluates the rules and nested groups of a filter group
+func evaluateFilterGroup(record map[string]interface{}, group FilterGroup) (bool, error) {
+	isOr := strings.ToUpper(group.Logic) == "OR"
+
+	for _, rule := range group.Rules {
+		result, err := evaluateRule(record, rule)
+		if err != nil {
+			return false, err
+		}
+		if result == isOr {
+			return isOr, nil
+		}
+	}
+	for _, nested := range group.Groups {
+		result, err := evaluateFilterGroup(record, nested)
+		if err != nil {
+			return false, err
+		}
+		if result == isOr {
+			return isOr, nil
+		}
+	}
+
+	// AND matches when nothing failed, OR fails when nothing matched
+	return !isOr, nil
+}
+
+// parseCondition reads a "key operator value" condition of a declarative expression.
+// Values may contain spaces and may be quoted, exists and not_exists take no value.
+func parseCondition(condition string) (Rule, error) {
+	parts := strings.Fields(strings.TrimSpace(condition))
+	if len(parts) < 2 {
+		return Rule{}, fmt.Errorf("invalid condition: %s", condition)
+	}
+
+	rule := Rule{Key: parts[0], Op: parts[1]}
+	switch strings.ToLower(rule.Op) {
+	case "exists", "not_exists":
+		if len(parts) != 2 {
+			return Rule{}, fmt.Errorf("invalid condition: %s", condition)
+		}
+		return rule, nil
+	}
+
+	if len(parts) < 3 {
+		return Rule{}, fmt.Errorf("invalid condition: %s", condition)
+	}
+
+	// The value is the rest of the condition, quoted values keep their inner spacing
+	value := strings.TrimSpace(condition)
+	for _, part := range parts[:2] {
+		value = strings.TrimSpace(strings.TrimPrefix(value, part))
+	}
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		rule.Value = value[1 : len(value)-1]
+	} else {
+		rule.Value = strings.Trim(value, `"'`)
+	}
+	return rule, nil
+}
+
+// splitOutsideQuotes splits a declarative expression on a separator, ignoring the
+// separators inside single or double quoted values
+func splitOutsideQuotes(expression string, separator string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(expression); i++ {
+		switch {
+		case quote != 0:
+			if expression[i] == quote {
+				quote = 0
+			}
+		case expression[i] == '"' || expression[i] == '\'':
+			quote = expression[i]
+		case strings.HasPrefix(expression[i:], separator):
+			parts = append(parts, expression[start:i])
+			i += len(separator) - 1
+			start = i + 1
+		}
+	}
+	return append(parts, expression[start:])
+}
+
+// validateComplexRule checks the syntax of a declarative expression
+func validateComplexRule(expression string) error {
+	for _, alternative := range splitOutsideQuotes(expression, "||") {
+		for _, condition := range splitOutsideQuotes(alternative, "&&") {
+			rule, err := parseCondition(condition)
+			if err != nil {
+				return err
+			}
+			if err := validateRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateRule checks the operator and value of a single declarative rule
+func validateRule(rule Rule) error {
+	if rule.Key == "" {
+		return fmt.Errorf("rule key is required")
+	}
+	if !supportedRuleOperators[strings.ToLower(rule.Op)] {
+		return fmt.Errorf("unsupported operator %s", rule.Op)
+	}
+
+	switch strings.ToLower(rule.Op) {
+	case "regex":
+		if _, err := compileRulePattern(toString(rule.Value)); err != nil {
+			return err
+		}
+	case "between":
+		if len(ruleValues(rule.Value)) != 2 {
+			return fmt.Errorf("between expects two bounds for %s", rule.Key)
+		}
+	}
+	return nil
+}
+
+// ruleValue returns the value of a rule key, matched exactly or as a path
+func ruleValue(data map[string]interface{}, key string) (interface{}, bool) {
+	if value, exists := data[key]; exists {
+		return value, true
+	}
+	return lookupPath(data, key)
+}
+
+// ruleValues returns the list value of in, not_in and between rules. Strings are read
+// as comma separated lists, optionally wrapped in brackets.
+func ruleValues(value interface{}) []interface{} {
+	if items, ok := value.([]interface{}); ok {
+		return items
+	}
+	text := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(toString(value)), "["), "]")
+	var items []interface{}
+	for _, item := range strings.Split(text, ",") {
+		items = append(items, strings.Trim(strings.TrimSpace(item), `"'`))
+	}
+	return items
+}
+
+// compareValues compares two values, numerically when both are numbers or numeric
+// strings, as booleans when both are booleans, and as text otherwise
+func compareValues(a interface{}, b interface{}) int {
+	if left, err := toFloat(a); err == nil {
+		if right, err := toFloat(b); err == nil {
+			switch {
+			case left < right:
+				return -1
+			case left > right:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+	if left, ok := a.(bool); ok {
+		if right, err := toBool(b); err == nil {
+			if left == right {
+				return 0
+			}
+			if !left {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(toString(a), toString(b))
+}
+
+// orderedComparison applies an ordering operator, which only makes sense for numbers,
+// dates and strings
+func orderedComparison(value interface{}, rule Rule, accept func(int) bool) (bool, error) {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return false, fmt.Errorf("invalid comparison for %s on %s", rule.Op, rule.Key)
+	}
+	return accept(compareValues(value, rule.Value)), nil
+}
+
+// compileRulePattern compiles a regex rule once and reuses it afterwards
+func compileRulePattern(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := rulePatterns.get(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	rulePatterns.add(pattern, compiled)
+	return compiled, nil
+}
+
+// validateFilterGroup checks the rules and nested groups of a filter group
+func validateFilterGroup(errs *ValidationErrors, field string, group FilterGroup) {
+	switch strings.ToUpper(group.Logic) {
+	case "", "AND", "OR":
+	default:
+		errs.add(field+".Logic", "must be AND or OR")
+	}
+	if len(group.Rules) == 0 && len(group.Groups) == 0 {
+		errs.add(field, "must contain at least one rule or group")
+	}
+	for i, rule := range group.Rules {
+		if err := validateRule(rule); err != nil {
+			errs.add(fmt.Sprintf("%s.Rules[%d]", field, i), "%v", err)
+		}
+	}
+	for i, nested := range group.Groups {
+		validateFilterGroup(errs, fmt.Sprintf("%s.Groups[%d]", field, i), nested)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+func TestEvaluateComplexRule(t *testing.T) {
+	record := map[string]interface{}{
+		"Country":    "USA",
+		"CustomerID": int64(12),
+		"Name":       "Tom && Jerry",
+		"Email":      nil,
+		"Score":      7.5,
+	}
+
+	tests := []struct {
+		expression string
+		want       bool
+		wantErr    bool
+	}{
+		{expression: "Country == USA", want: true},
+		{expression: "Country == USA && CustomerID >= 10", want: true},
+		{expression: "Country == France || CustomerID > 10", want: true},
+		{expression: "Country == France || CustomerID > 20", want: false},
+		{expression: `Name == "Tom && Jerry"`, want: true},
+		{expression: "Name == 'Tom || Jerry' || Score < 5", want: false},
+		{expression: "Email exists", want: false},
+		{expression: "Email not_exists && Score between 5,10", want: true},
+		{expression: "Country in USA,Canada", want: true},
+		{expression: "Missing == 1", want: false},
+		{expression: "Country", wantErr: true},
+		{expression: "Score like 7", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := evaluateComplexRule(record, test.expression)
+		if (err != nil) != test.wantErr {
+			t.Errorf("evaluateComplexRule(%q) error = %v, want error %v", test.expression, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("evaluateComplexRule(%q) = %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestEvaluateFilterGroup(t *testing.T) {
+	record := map[string]interface{}{"Region": "EU", "Amount": int64(150), "Email": "ada@example.com"}
+
+	tests := []struct {
+		name  string
+		group FilterGroup
+		want  bool
+	}{
+		{
+			name:  "and",
+			group: FilterGroup{Rules: []Rule{{Key: "Region", Op: "==", Value: "EU"}, {Key: "Amount", Op: ">", Value: 100}}},
+			want:  true,
+		},
+		{
+			name:  "and failing",
+			group: FilterGroup{Rules: []Rule{{Key: "Region", Op: "==", Value: "EU"}, {Key: "Amount", Op: "<", Value: "100"}}},
+			want:  false,
+		},
+		{
+			name:  "or",
+			group: FilterGroup{Logic: "OR", Rules: []Rule{{Key: "Region", Op: "==", Value: "US"}, {Key: "Email", Op: "regex", Value: `@example\.com$`}}},
+			want:  true,
+		},
+		{
+			name: "nested",
+			group: FilterGroup{
+				Rules: []Rule{{Key: "Amount", Op: "between", Value: []interface{}{100, 200}}},
+				Groups: []FilterGroup{{Logic: "OR", Rules: []Rule{
+					{Key: "Region", Op: "in", Value: []interface{}{"EU", "UK"}},
+					{Key: "Region", Op: "exists"},
+				}}},
+			},
+			want: true,
+		},
+		{
+			name:  "not in",
+			group: FilterGroup{Rules: []Rule{{Key: "Region", Op: "not_in", Value: "US,UK"}}},
+			want:  true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := evaluateFilterGroup(record, test.group)
+		if err != nil || got != test.want {
+			t.Errorf("%s: evaluateFilterGroup = %v, %v, want %v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestValidateFilterGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   FilterGroup
+		wantErr bool
+	}{
+		{name: "valid", group: FilterGroup{Rules: []Rule{{Key: "Region", Op: "==", Value: "EU"}}}},
+		{name: "empty", group: FilterGroup{}, wantErr: true},
+		{name: "empty nested", group: FilterGroup{Rules: []Rule{{Key: "Region", Op: "exists"}}, Groups: []FilterGroup{{}}}, wantErr: true},
+		{name: "unknown operator", group: FilterGroup{Rules: []Rule{{Key: "Region", Op: "like", Value: "E%"}}}, wantErr: true},
+		{name: "unknown logic", group: FilterGroup{Logic: "XOR", Rules: []Rule{{Key: "Region", Op: "exists"}}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		var errs ValidationErrors
+		validateFilterGroup(&errs, "Filter", test.group)
+		if (len(errs) > 0) != test.wantErr {
+			t.Errorf("%s: errors = %v, want errors %v", test.name, errs, test.wantErr)
+		}
+	}
+}
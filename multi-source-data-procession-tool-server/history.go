@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gofr.dev/pkg/gofr"
+)
+
+// configVersion describes one saved version of a configuration file
+type configVersion struct {
+	Version   int       `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Author    string    `json:"author"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// configDiff is the line based difference between two versions of a configuration
+type configDiff struct {
+	ConfigType string   `json:"configType"`
+	From       int      `json:"from"`
+	To         int      `json:"to"`
+	Changes    []string `json:"changes"`
+}
+
+// VersionNotFoundError is returned with HTTP 404 when a version does not exist
+type VersionNotFoundError struct {
+	ConfigType string
+	Version    int
+}
+
+func (e VersionNotFoundError) Error() string {
+	return fmt.Sprintf("version %d of %s not found", e.Version, e.ConfigType)
+}
+
+// StatusCode makes GoFr respond with 404 Not Found
+func (e VersionNotFoundError) StatusCode() int {
+	return http.StatusNotFound
+}
+
+// Serialises writes to the configuration files and their history
+var historyMu sync.Mutex
+
+// historyDir returns the directory holding the versions of a config type
+func historyDir(configType string) string {
+	return filepath.Join(configDir(), "history", configType)
+}
+
+// readHistory returns the versions of a config type, oldest first
+func readHistory(configType string) ([]configVersion, error) {
+	var versions []configVersion
+
+	indexData, err := ioutil.ReadFile(filepath.Join(historyDir(configType), "index.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(indexData, &versions)
+	return versions, err
+}
+
+// readVersion returns the YAML content of a stored version
+func readVersion(configType string, version int) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(historyDir(configType), strconv.Itoa(version)+".yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, VersionNotFoundError{ConfigType: configType, Version: version}
+	}
+	return data, err
+}
+
+// appendVersion stores content as the next version of a config type
+func appendVersion(configType string, versions []configVersion, content []byte, author string, comment string) ([]configVersion, configVersion, error) {
+	entry := configVersion{
+		Version:   1,
+		Timestamp: time.Now().UTC(),
+		Author:    author,
+		Comment:   comment,
+	}
+	if len(versions) > 0 {
+		entry.Version = versions[len(versions)-1].Version + 1
+	}
+
+	dir := historyDir(configType)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return versions, entry, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(entry.Version)+".yaml"), content, 0644); err != nil {
+		return versions, entry, err
+	}
+
+	versions = append(versions, entry)
+	indexData, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return versions, entry, err
+	}
+	return versions, entry, ioutil.WriteFile(filepath.Join(dir, "index.json"), indexData, 0644)
+}
+
+// saveConfiguration writes a configuration file and records it as a new version
+func saveConfiguration(configType string, content []byte, author string, comment string) (configVersion, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	fileName, err := configFilePath(configType)
+	if err != nil {
+		return configVersion{}, err
+	}
+
+	versions, err := readHistory(configType)
+	if err != nil {
+		return configVersion{}, err
+	}
+
+	// Keep the file that was there before history existed as the first version
+	if len(versions) == 0 {
+		if previous, err := ioutil.ReadFile(fileName); err == nil {
+			versions, _, err = appendVersion(configType, versions, previous, "unknown", "initial version")
+			if err != nil {
+				return configVersion{}, err
+			}
+		}
+	}
+
+	// Write the YAML data to a file inside the config directory
+	err = os.MkdirAll(configDir(), 0755)
+	if err != nil {
+		return configVersion{}, err
+	}
+	err = ioutil.WriteFile(fileName, content, 0644)
+	if err != nil {
+		return configVersion{}, err
+	}
+	// Set file permissions
+	if err := os.Chmod(fileName, 0771); err != nil {
+		log.Println("Failed to change file permission:", err)
+	}
+
+	_, entry, err := appendVersion(configType, versions, content, author, comment)
+	return entry, err
+}
+
+// requestAuthor returns the authenticated caller of the request, or the author named
+// in the request when the management API is not protected
+func requestAuthor(c *gofr.Context) string {
+	if caller, ok := requestIdentity(c); ok {
+		return caller.Name
+	}
+	if author := c.Param("author"); author != "" {
+		return author
+	}
+	return "unknown"
+}
+
+// listConfigurationVersions returns the saved versions of a configuration
+func listConfigurationVersions(c *gofr.Context) (interface{}, error) {
+	defer panicRecoveryMiddleware()
+
+	configType := c.Param("configType")
+	if _, err := configFilePath(configType); err != nil {
+		return nil, err
+	}
+
+	versions, err := readHistory(configType)
+	if err != nil {
+		log.Println("Failed to read configuration history:", err)
+		return nil, err
+	}
+	return versions, nil
+}
+
+// diffConfiguration compares two versions of a configuration. When "to" is omitted
+// the version is compared with the latest one.
+func diffConfiguration(c *gofr.Context) (interface{}, error) {
+	defer panicRecoveryMiddleware()
+
+	configType := c.Param("configType")
+	if _, err := configFilePath(configType); err != nil {
+		return nil, err
+	}
+
+	versions, err := readHistory(configType)
+	if err != nil {
+		log.Println("Failed to read configuration history:", err)
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, VersionNotFoundError{ConfigType: configType, Version: 1}
+	}
+
+	from, err := versionParam(c, "from", versions[0].Version)
+	if err != nil {
+		return nil, err
+	}
+	to, err := versionParam(c, "to", versions[len(versions)-1].Version)
+	if err != nil {
+		return nil, err
+	}
+
+	fromData, err := readVersion(configType, from)
+	if err != nil {
+		return nil, err
+	}
+	toData, err := readVersion(configType, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plaintext secrets are not shown in the differences
+	if fromData, err = redactConfigYAML(fromData); err != nil {
+		return nil, err
+	}
+	if toData, err = redactConfigYAML(toData); err != nil {
+		return nil, err
+	}
+
+	return configDiff{
+		ConfigType: configType,
+		From:       from,
+		To:         to,
+		Changes:    diffLines(string(fromData), string(toData)),
+	}, nil
+}
+
+// rollbackConfiguration restores a previous version as the newest one and optionally
+// deploys it through the refresh flow
+func rollbackConfiguration(c *gofr.Context) (interface{}, error) {
+	defer panicRecoveryMiddleware()
+
+	configType := c.Param("configType")
+	if _, err := configFilePath(configType); err != nil {
+		return nil, err
+	}
+
+	version, err := versionParam(c, "version", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := readVersion(configType, version)
+	if err != nil {
+		log.Println("Failed to read configuration version:", err)
+		return nil, err
+	}
+
+	entry, err := saveConfiguration(configType, content, requestAuthor(c), fmt.Sprintf("rollback to version %d", version))
+	if err != nil {
+		log.Println("Failed to roll back configuration:", err)
+		return nil, err
+	}
+	recordAuditVersion(c, entry.Version)
+
+	if c.Param("deploy") == "true" {
+		if err := deployConfiguration(configType); err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// versionParam reads a version number from the query, falling back to def when absent
+func versionParam(c *gofr.Context, name string, def int) (int, error) {
+	value := c.Param(name)
+	if value == "" {
+		if def == 0 {
+			return 0, ValidationErrors{{Field: name, Message: "is required"}}
+		}
+		return def, nil
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version <= 0 {
+		return 0, ValidationErrors{{Field: name, Message: "must be a positive version number"}}
+	}
+	return version, nil
+}
+
+// diffLines returns the lines of both texts prefixed with "-" when removed, "+" when
+// added and " " when unchanged, based on their longest common subsequence
+func diffLines(from string, to string) []string {
+	a := strings.Split(strings.TrimRight(from, "\n"), "\n")
+	b := strings.Split(strings.TrimRight(to, "\n"), "\n")
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	changes := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			changes = append(changes, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			changes = append(changes, "-"+a[i])
+			i++
+		default:
+			changes = append(changes, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		changes = append(changes, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		changes = append(changes, "+"+b[j])
+	}
+	return changes
+}
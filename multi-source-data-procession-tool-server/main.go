@@ -9,14 +9,14 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"reflect"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/PaesslerAG/gval"
 	"github.com/go-resty/resty/v2"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"gofr.dev/pkg/gofr"
 	"gopkg.in/yaml.v3"
 
@@ -27,20 +27,34 @@ import (
 var stopChannels = make(map[string]chan bool)
 var mu sync.Mutex
 
+// Replication slots of the running CDC workers, by worker name
+var cdcSlots = make(map[string]string)
+
 // Rule structure defines rules for transformation or filtering
 type Rule struct {
-	Key   string      // The key in the data
-	Value interface{} // The value to compare against
-	Op    string      // The operation (e.g., "==", ">", "<")
+	Key   string      `yaml:"Key" json:"Key"`     // The key in the data
+	Value interface{} `yaml:"Value" json:"Value"` // The value to compare against
+	Op    string      `yaml:"Op" json:"Op"`       // The operation (e.g., "==", ">", "<")
 }
 
-// Global variable for final output data after transformation
-var finalOutputData = make(map[string]interface{})
+// FilterGroup combines rules and nested groups with AND or OR
+type FilterGroup struct {
+	Logic  string        `yaml:"Logic" json:"Logic"` // AND (default) or OR
+	Rules  []Rule        `yaml:"Rules" json:"Rules"`
+	Groups []FilterGroup `yaml:"Groups" json:"Groups"`
+}
 
 // Structure for the final output data in JSON format
 type finalOutputDataJSON struct {
 	RuleType     string                `yaml:"RuleType" json:"RuleType"`
 	OutputFormat []outputRuleStructure `yaml:"OutputFormat" json:"OutputFormat"`
+
+	// FilterType selects how RuleType is read: GVAL (default) or DECLARATIVE
+	FilterType string       `yaml:"FilterType,omitempty" json:"FilterType,omitempty"`
+	Filter     *FilterGroup `yaml:"Filter,omitempty" json:"Filter,omitempty"`
+
+	// Steps run in order after the filter and before OutputFormat
+	Steps []TransformationStep `yaml:"Steps,omitempty" json:"Steps,omitempty"`
 }
 
 // Structure for output rule with fields for key, display name, key type, rule, and nested structure
@@ -50,6 +64,19 @@ type outputRuleStructure struct {
 	KeyType     string                `yaml:"KeyType" json:"KeyType"`
 	Rule        string                `yaml:"Rule" json:"Rule"`
 	Structure   []outputRuleStructure `yaml:"Structure" json:"Structure"`
+
+	// DateFormat is the Go layout used to parse DATE values
+	DateFormat string `yaml:"DateFormat,omitempty" json:"DateFormat,omitempty"`
+	// OnError is applied when the value cannot be converted: NULL (default), DEFAULT or REJECT
+	OnError string      `yaml:"OnError,omitempty" json:"OnError,omitempty"`
+	Default interface{} `yaml:"Default,omitempty" json:"Default,omitempty"`
+
+	// Mask hides personal data in the output: REDACT, PARTIAL (all but the last MaskKeep
+	// characters, 4 by default), HASH (HMAC-SHA256 of the value keyed by Salt) or
+	// TOKENIZE (a token with the format of the value, keyed by Salt)
+	Mask     string `yaml:"Mask,omitempty" json:"Mask,omitempty"`
+	MaskKeep *int   `yaml:"MaskKeep,omitempty" json:"MaskKeep,omitempty"`
+	Salt     string `yaml:"Salt,omitempty" json:"Salt,omitempty" secret:"true"`
 }
 
 // Configuration data structure with a list of data sources
@@ -69,6 +96,17 @@ type DataSource struct {
 	InputName            string              `yaml:"NAME" json:"NAME"`
 	Config               []Config            `yaml:"TYPEOF" json:"TYPEOF"`
 	TransformationConfig finalOutputDataJSON `yaml:"TransformationConfig" json:"TransformationConfig"`
+
+	// DeadLetter receives the records rejected while processing this source
+	DeadLetter *Config `yaml:"DeadLetter,omitempty" json:"DeadLetter,omitempty"`
+
+	// Schema, or the JSON Schema file at SchemaFile, rejects the incoming records that
+	// do not match it before they are transformed
+	Schema     map[string]interface{} `yaml:"Schema,omitempty" json:"Schema,omitempty"`
+	SchemaFile string                 `yaml:"SchemaFile,omitempty" json:"SchemaFile,omitempty"`
+
+	// schema is Schema or SchemaFile compiled when the source is deployed
+	schema *jsonschema.Schema
 }
 
 // Configuration structure for various data sources
@@ -78,17 +116,57 @@ type Config struct {
 	DBHost     string `yaml:"DB_HOST" json:"DB_HOST"`
 	DBPort     int    `yaml:"DB_PORT" json:"DB_PORT"`
 	DBUser     string `yaml:"DB_USER" json:"DB_USER"`
-	DBPassword string `yaml:"DB_PASSWORD" json:"DB_PASSWORD"`
+	DBPassword string `yaml:"DB_PASSWORD" json:"DB_PASSWORD" secret:"true"`
 	DBName     string `yaml:"DB_NAME" json:"DB_NAME"`
 	TableName  string `yaml:"DB_TABLE_NAME" json:"DB_TABLE_NAME"`
 	Duration   string `yaml:"Duration" json:"Duration"`
 	FilePath   string `yaml:"FILE_PATH" json:"FILE_PATH"`
 	S3Bucket   string `yaml:"S3_BUCKET" json:"S3_BUCKET"`
 	S3Region   string `yaml:"S3_REGION" json:"S3_REGION"`
-	URL        string `yaml:"URL" json:"URL"`
+	URL        string `yaml:"URL" json:"URL" secret:"url"`
 	IP         string `yaml:"IP" json:"IP"`
 	Port       string `yaml:"Port" json:"Port"`
 	TopicName  string `yaml:"TopicName" json:"TopicName"`
+
+	// DBSSLMode is the PostgreSQL sslmode of a DB connection, mapped to the TLS setting
+	// of the MySQL driver. The driver default applies when empty.
+	DBSSLMode string `yaml:"DB_SSL_MODE,omitempty" json:"DB_SSL_MODE,omitempty"`
+
+	// OrderingKey keeps records with the same key value in arrival order for this destination
+	OrderingKey     string `yaml:"OrderingKey,omitempty" json:"OrderingKey,omitempty"`
+	OrderingWorkers int    `yaml:"OrderingWorkers,omitempty" json:"OrderingWorkers,omitempty"`
+
+	// Route is an expression selecting the records sent to this destination, DefaultRoute
+	// receives the records no Route matched
+	Route        string `yaml:"Route,omitempty" json:"Route,omitempty"`
+	DefaultRoute bool   `yaml:"DefaultRoute,omitempty" json:"DefaultRoute,omitempty"`
+
+	// TransformationConfig overrides the transformation of the source for this destination
+	TransformationConfig *finalOutputDataJSON `yaml:"TransformationConfig,omitempty" json:"TransformationConfig,omitempty"`
+
+	// Dedup drops the records an API source already delivered
+	Dedup *DedupConfig `yaml:"Dedup,omitempty" json:"Dedup,omitempty"`
+
+	// SchemaRegistry serializes the records sent to a Kafka destination with a registered
+	// Avro or JSON Schema
+	SchemaRegistry *SchemaRegistryConfig `yaml:"SchemaRegistry,omitempty" json:"SchemaRegistry,omitempty"`
+
+	// Query replaces the SELECT of a whole DB_TABLE_NAME. Named parameters such as
+	// ":region" take their values from QueryParams, and ":last_watermark" is the highest
+	// WatermarkColumn value already read (InitialWatermark before the first read).
+	Query            string                 `yaml:"Query,omitempty" json:"Query,omitempty"`
+	QueryParams      map[string]interface{} `yaml:"QueryParams,omitempty" json:"QueryParams,omitempty"`
+	WatermarkColumn  string                 `yaml:"WatermarkColumn,omitempty" json:"WatermarkColumn,omitempty"`
+	InitialWatermark interface{}            `yaml:"InitialWatermark,omitempty" json:"InitialWatermark,omitempty"`
+
+	// Slot and Publication of a POSTGRES_CDC source. The slot is created on first start,
+	// the publication must exist and lists the tables whose changes are streamed.
+	Slot        string `yaml:"Slot,omitempty" json:"Slot,omitempty"`
+	Publication string `yaml:"Publication,omitempty" json:"Publication,omitempty"`
+
+	// ChangeDetection sends the inserts, updates and deletes between the snapshots of an
+	// API or DB source instead of the snapshots
+	ChangeDetection *ChangeDetectionConfig `yaml:"ChangeDetection,omitempty" json:"ChangeDetection,omitempty"`
 }
 
 // Sale record structure for customer sales data
@@ -102,16 +180,43 @@ type SaleRecord struct {
 // Global variables for HTTP client and destination configuration
 var client *resty.Client
 var destinationConfig = make(map[int]DataSource)
+var destinationMu sync.RWMutex
+
+// getDestinationConfig returns the deployed destination configuration of a source
+func getDestinationConfig(sourceID int) (DataSource, bool) {
+	destinationMu.RLock()
+	defer destinationMu.RUnlock()
+	config, ok := destinationConfig[sourceID]
+	return config, ok
+}
+
+// destinationConfigs returns a copy of every deployed destination configuration
+func destinationConfigs() map[int]DataSource {
+	destinationMu.RLock()
+	defer destinationMu.RUnlock()
+	configs := make(map[int]DataSource, len(destinationConfig))
+	for sourceID, config := range destinationConfig {
+		configs[sourceID] = config
+	}
+	return configs
+}
 
 // main function initializes the GoFr app and sets up routes
 func main() {
 	client = resty.New()
 	app := gofr.New()
+	registerMetrics(app.Metrics())
+	app.UseMiddleware(newAuthMiddleware())
 
 	// Set up API routes
 	app.POST("/updateConfiguration", updateConfiguration)
 	app.GET("/loadConfiguration", loadConfiguration)
 	app.POST("/refreshConfiguration", refreshConfiguration)
+	app.GET("/configurationVersions", listConfigurationVersions)
+	app.GET("/configurationDiff", diffConfiguration)
+	app.POST("/rollbackConfiguration", rollbackConfiguration)
+	app.POST("/preview", previewTransformation)
+	app.POST("/stopWorker", stopWorkerHandler)
 	app.GET("/health", healthCheckHandler)
 
 	// Run the app
@@ -133,11 +238,31 @@ func updateConfiguration(c *gofr.Context) (interface{}, error) {
 		return nil, err
 	}
 
-	log.Println("Received data:", inputData)
+	log.Printf("Received %s with %d data sources", configType, len(inputData.DataSourceConfig))
 
-	// Define the file name based on the config type
-	fileName := configType + ".yaml"
+	if _, err := configFilePath(configType); err != nil {
+		log.Println("Invalid config type:", err)
+		return nil, err
+	}
 	if len(inputData.DataSourceConfig) > 0 {
+		// Keep the saved secrets of the fields sent back redacted by loadConfiguration
+		var savedData ConfigData
+		if fileName, _ := configFilePath(configType); fileName != "" {
+			if readData, err := ioutil.ReadFile(fileName); err == nil {
+				yaml.Unmarshal(readData, &savedData)
+			}
+		}
+		if err := restoreRedactedSecrets(&inputData, savedData); err != nil {
+			log.Println("Redacted secrets without a saved value:", err)
+			return nil, err
+		}
+
+		// Reject the configuration before it reaches the disk
+		if errs := validateConfiguration(configType, inputData); len(errs) > 0 {
+			log.Println("Invalid configuration:", errs)
+			return nil, errs
+		}
+
 		// Marshal the data into YAML format
 		fileData, err := yaml.Marshal(inputData)
 		if err != nil {
@@ -145,18 +270,33 @@ func updateConfiguration(c *gofr.Context) (interface{}, error) {
 			return nil, err
 		}
 
-		// Write the YAML data to a file
-		err = ioutil.WriteFile(fileName, fileData, 0644)
+		// Refuse destination schemas the registries would reject at deploy. The registries
+		// are reached with the resolved secrets of a copy, the file keeps the references.
+		if configType == "destinationConfig" {
+			var resolvedData ConfigData
+			if err := yaml.Unmarshal(fileData, &resolvedData); err != nil {
+				log.Println("Error unmarshalling YAML:", err)
+				return nil, err
+			}
+			if err := resolveSecrets(&resolvedData); err != nil {
+				log.Println("Failed to resolve secrets:", err)
+				return nil, err
+			}
+			for _, dataSource := range resolvedData.DataSourceConfig {
+				if _, err := prepareOutputSchemas(dataSource); err != nil {
+					log.Println("Schema check failed:", err)
+					return nil, err
+				}
+			}
+		}
+
+		// Write the file and keep it as a new version in the history
+		entry, err := saveConfiguration(configType, fileData, requestAuthor(c), c.Param("comment"))
 		if err != nil {
 			log.Println("Error writing to file:", err)
 			return nil, err
-		} else {
-			// Set file permissions
-			err := os.Chmod(fileName, 0771)
-			if err != nil {
-				log.Println("Failed to change file permission:", err)
-			}
 		}
+		recordAuditVersion(c, entry.Version)
 	} else {
 		return nil, errors.New("empty data")
 	}
@@ -171,8 +311,14 @@ func loadConfiguration(c *gofr.Context) (interface{}, error) {
 	var inputData ConfigData
 	configType := c.Param("configType")
 
+	fileName, err := configFilePath(configType)
+	if err != nil {
+		log.Println("Invalid config type:", err)
+		return nil, err
+	}
+
 	// Read the configuration file
-	readData, err := ioutil.ReadFile(configType + ".yaml")
+	readData, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		log.Println("Failed to load config:", err)
 		return nil, err
@@ -183,6 +329,7 @@ func loadConfiguration(c *gofr.Context) (interface{}, error) {
 	if err != nil {
 		log.Println("Error unmarshalling YAML:", err)
 	}
+	redactSecrets(&inputData)
 
 	// Marshal the map to JSON
 	jsonData, err := json.Marshal(inputData)
@@ -198,16 +345,31 @@ func loadConfiguration(c *gofr.Context) (interface{}, error) {
 func refreshConfiguration(c *gofr.Context) (interface{}, error) {
 	defer panicRecoveryMiddleware()
 
-	var configType string
+	configType := c.Param("configType")
+	log.Println("Config type:", configType)
+
+	if err := deployConfiguration(configType); err != nil {
+		return nil, err
+	}
+
+	return "SUCCESSFUL", nil
+}
+
+// deployConfiguration reads a saved configuration and starts or updates its workers
+func deployConfiguration(configType string) error {
 	var incomingData ConfigData
 
-	configType = c.Param("configType")
-	log.Println("Config type:", configType)
+	fileName, err := configFilePath(configType)
+	if err != nil {
+		log.Println("Invalid config type:", err)
+		return err
+	}
+
 	// Read the configuration file
-	readData, err := ioutil.ReadFile(configType + ".yaml")
+	readData, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		log.Println("Failed to load config:", err)
-		return nil, err
+		return err
 	}
 
 	// Unmarshal YAML data into the ConfigData struct
@@ -216,149 +378,468 @@ func refreshConfiguration(c *gofr.Context) (interface{}, error) {
 		log.Println("Error unmarshalling YAML:", err)
 	}
 
+	// Replace the secret references by their values
+	if err := resolveSecrets(&incomingData); err != nil {
+		log.Println("Failed to resolve secrets:", err)
+		return err
+	}
+
 	// Handling sourceConfig and destinationConfig
 	if configType == "sourceConfig" {
-
+		// Connectors removed from the configuration must not keep running, and the slots
+		// no CDC connector uses anymore are dropped
+		keptSlots := make(map[string]bool)
 		for _, sourceConfig := range incomingData.DataSourceConfig {
 			for _, config := range sourceConfig.Config {
-				stopWorker(config.Type)
+				if config.Type == "POSTGRES_CDC" {
+					keptSlots[cdcSlotKey(config)] = true
+				}
+			}
+		}
+		stopAllWorkers(keptSlots)
 
-				// Create a stop channel for this worker
-				stopChan := make(chan bool)
+		for _, sourceConfig := range incomingData.DataSourceConfig {
+			for index, config := range sourceConfig.Config {
+				// Create a stop channel for this worker, with room for the retire signal
+				stopChan := make(chan bool, 1)
 
 				// Store the stop channel globally so it can be used to kill the worker
+				name := workerName(sourceConfig.Source, index)
 				mu.Lock()
-				stopChannels["API"] = stopChan
+				stopChannels[name] = stopChan
+				if config.Type == "POSTGRES_CDC" {
+					cdcSlots[name] = cdcSlotKey(config)
+				}
 				mu.Unlock()
 				// Handle different config types (HTTP, DB, Kafka, etc.)
 				switch config.Type {
 				case "API":
 					log.Println("HTTP input handler")
-					handleAPIInput(sourceConfig.Source, config, stopChan)
+					go handleAPIInput(sourceConfig.Source, index, config, stopChan)
 				case "KAFKA":
 					log.Println("Kafka input handler")
-					startKafkaSubscription(sourceConfig.Source, config.IP, config.Port, config.TopicName, stopChan)
+					go startKafkaSubscription(sourceConfig.Source, config.IP, config.Port, config.TopicName, stopChan)
+				case "DB":
+					log.Println("Database input handler")
+					go handleDatabaseInput(sourceConfig.Source, index, config, stopChan)
+				case "POSTGRES_CDC":
+					log.Println("PostgreSQL CDC input handler")
+					go handlePostgresCDC(sourceConfig.Source, index, config, stopChan)
 				default:
 					// CSV
-					ReadFile(sourceConfig.Source, config.FilePath)
+					ReadFile(sourceConfig.Source, config)
 					log.Println("Unknown configuration type")
 				}
 			}
 		}
 	} else if configType == "destinationConfig" {
-		// Read the destination configuration
-		readData, err := ioutil.ReadFile(configType + ".yaml")
-		if err != nil {
-			log.Println("Failed to load config:", err)
-			return nil, err
+		log.Println("Deploying destination configuration")
+
+		// Compile the schemas once, a schema file that changed since validation fails here
+		for i := range incomingData.DataSourceConfig {
+			schema, err := sourceSchema(incomingData.DataSourceConfig[i])
+			if err != nil {
+				log.Println("Failed to compile schema:", err)
+				return fmt.Errorf("schema of source %d: %v", incomingData.DataSourceConfig[i].Source, err)
+			}
+			incomingData.DataSourceConfig[i].schema = schema
 		}
 
-		// Unmarshal destination config data
-		err = yaml.Unmarshal(readData, &incomingData)
-		if err != nil {
-			log.Println("Error unmarshalling YAML:", err)
+		// Register the schemas of the Kafka destinations before anything is replaced, so an
+		// incompatible schema leaves the running configuration untouched
+		schemas := make(map[string]*outputSchema)
+		for _, sourceConfig := range incomingData.DataSourceConfig {
+			prepared, err := prepareOutputSchemas(sourceConfig)
+			if err != nil {
+				log.Println("Failed to check output schema:", err)
+				return err
+			}
+			for key, schema := range prepared {
+				schemas[key] = schema
+			}
+		}
+		if err := registerOutputSchemas(schemas); err != nil {
+			log.Println("Failed to register output schema:", err)
+			return err
 		}
 
-		log.Println("Destination configuration", incomingData)
 		for _, sourceConfig := range incomingData.DataSourceConfig {
+			// Flush the windows of the previous deployment into its ordered lanes, then
+			// drain the lanes
+			resetWindowAggregators(sourceConfig.Source)
+			resetOrderedDispatchers(sourceConfig.Source)
+
 			// Store the source configuration in the global map
+			destinationMu.Lock()
 			destinationConfig[sourceConfig.Source] = sourceConfig
+			destinationMu.Unlock()
 		}
+		registerLookupIndexes(destinationConfigs())
 	}
 
-	return "SUCCESSFUL", nil
+	return nil
 }
 
-// startKafkaSubscription starts consuming messages from a Kafka topic
+// startKafkaSubscription consumes the messages of a Kafka topic until the worker is
+// stopped. A broker that cannot be reached stops the worker, not the server.
 func startKafkaSubscription(sourceID int, ip string, port string, topicName string, stopChan chan bool) {
+	if err := consumeKafkaTopic(sourceID, ip, port, topicName, stopChan); err != nil {
+		log.Println("Kafka input stopped:", err)
+	}
+}
+
+// consumeKafkaTopic processes the messages of a Kafka topic and closes its consumers
+// when stopChan fires
+func consumeKafkaTopic(sourceID int, ip string, port string, topicName string, stopChan chan bool) error {
 	// Set up Kafka consumer
 	consumer, err := sarama.NewConsumer([]string{ip + ":" + port}, nil)
 	if err != nil {
-		log.Fatal("Failed to start Kafka consumer:", err)
+		return fmt.Errorf("cannot start Kafka consumer: %v", err)
 	}
 	defer consumer.Close()
 
 	// Start consuming from the Kafka topic
 	partitionConsumer, err := consumer.ConsumePartition(topicName, 0, sarama.OffsetNewest)
 	if err != nil {
-		log.Fatal("Failed to start partition consumer:", err)
+		return fmt.Errorf("cannot start partition consumer: %v", err)
 	}
 	defer partitionConsumer.Close()
 
 	// Consume messages
-	for message := range partitionConsumer.Messages() {
-		go processData(sourceID, message.Value)
+	// Messages are handed over in partition order, processData takes care of concurrency
+	for {
+		select {
+		case message, ok := <-partitionConsumer.Messages():
+			if !ok {
+				return fmt.Errorf("partition consumer of topic %s was closed", topicName)
+			}
+			if data, ok := ingestData(sourceID, message.Value); ok {
+				processData(sourceID, data)
+			}
+		case <-stopChan:
+			fmt.Printf("%s is stopping...\n", "KAFKA")
+			return nil
+		}
 	}
 }
 
-// processData processes incoming data from Kafka or other sources
-func processData(sourceID int, data []byte) {
+// ingestData is the first step for the data read by every connector. Records failing
+// the Schema of the source are rejected, the others are kept for the pipelines enriching
+// their data with this source before change detection or dedup drop any of them. It
+// returns the payload of the valid records.
+func ingestData(sourceID int, data []byte) ([]byte, bool) {
+	records, single, err := decodeRecords(data)
+	if err != nil {
+		log.Println("Error decoding data:", err)
+		sendToDeadLetter(sourceID, map[string]interface{}{"payload": string(data)}, "cannot decode payload: "+err.Error())
+		return nil, false
+	}
+
+	if config, ok := getDestinationConfig(sourceID); ok {
+		valid := validateRecords(sourceID, config, records)
+		if len(valid) == 0 {
+			return nil, false
+		}
+		if len(valid) < len(records) {
+			if single {
+				data, err = json.Marshal(valid[0])
+			} else {
+				data, err = json.Marshal(valid)
+			}
+			if err != nil {
+				log.Println("Error marshalling records:", err)
+				return nil, false
+			}
+		}
+		records = valid
+	}
+
+	updateLookupIndexes(sourceID, records)
+	return data, true
+}
+
+// processData routes the data of a source to its destinations, transforms it for each
+// of them and sends it. Destinations without their own TransformationConfig use the
+// transformation of the source. The error is the last delivery that failed.
+func processData(sourceID int, data []byte) error {
+	_, err := processRecords(sourceID, data)
+	return err
+}
+
+// processRecords does the work of processData and also returns the positions of the
+// records that were not delivered, because a route or a transformation rejected them or
+// because the source has no destinations
+func processRecords(sourceID int, data []byte) (map[int]bool, error) {
 	log.Println("Processing data:", string(data))
 
-	if config, ok := destinationConfig[sourceID]; ok {
+	records, single, err := decodeRecords(data)
+	if err != nil {
+		log.Println("Error decoding data:", err)
+		sendToDeadLetter(sourceID, map[string]interface{}{"payload": string(data)}, "cannot decode payload: "+err.Error())
+		return nil, nil
+	}
+
+	undelivered := make(map[int]bool)
+	if config, ok := getDestinationConfig(sourceID); ok {
 		log.Println("Sending data to destination service")
-		for _, cfg := range config.Config {
-			switch cfg.Type {
-			case "API":
-				log.Println("HTTP output handler")
-				publishDataToAPIs(cfg.URL, data)
-			case "FILE":
-				log.Println("File output handler")
-			case "DB":
-				log.Println("Database output handler")
-			case "KAFKA":
-				log.Println("Kafka output handler")
-				publishDataToKafka(cfg.IP, cfg.Port, cfg.TopicName, string(data))
-			default:
-				publishDataToAPIs(cfg.URL, data)
-				log.Println("Unknown output type")
+
+		routed, failed := routeRecords(config, records)
+
+		// A record rejected by several destinations reaches the dead letter destination once
+		rejections := newRecordRejections(records)
+		defer rejections.send(sourceID)
+		for position := range records {
+			if err, ok := failed[position]; ok {
+				rejections.add(position, recordError{Index: position, Record: records[position], Error: err.Error()}, "")
+			}
+		}
+
+		// Destinations receiving every record with the source transformation share the result
+		var sharedOutput []byte
+		var sharedErr error
+		sharedDone := false
+
+		// Destinations are sent to in parallel, processData returns once all are done
+		var delivery sync.WaitGroup
+		var deliveryMu sync.Mutex
+		var deliveryErr error
+
+		for index, cfg := range config.Config {
+			positions := routed[index]
+			if len(positions) == 0 {
+				continue
+			}
+			destinationSingle := single && len(positions) == 1
+			scope := pipelineScope{sourceID: sourceID, destination: index}
+
+			transformation := config.TransformationConfig
+			if cfg.TransformationConfig != nil {
+				transformation = *cfg.TransformationConfig
+			}
+
+			var output []byte
+			var recordErrs []recordError
+			var err error
+			if cfg.TransformationConfig == nil && len(positions) == len(records) && !hasAggregation(transformation) {
+				if !sharedDone {
+					sharedOutput, recordErrs, sharedErr = TransformationINHighLevel(scope, records, single, transformation)
+					for _, recordErr := range recordErrs {
+						rejections.add(recordErr.Index, recordErr, "")
+					}
+					sharedDone = true
+				}
+				output, err = sharedOutput, sharedErr
+			} else {
+				// Aggregations keep their own windows for every destination
+				destinationRecords := make([]map[string]interface{}, len(positions))
+				for i, position := range positions {
+					destinationRecords[i] = records[position]
+				}
+				output, recordErrs, err = TransformationINHighLevel(scope, destinationRecords, destinationSingle, transformation)
+				for _, recordErr := range recordErrs {
+					origin := -1
+					if recordErr.Index >= 0 {
+						origin = positions[recordErr.Index]
+					}
+					rejections.add(origin, recordErr, fmt.Sprintf("destination %d: ", index))
+				}
 			}
+			if err != nil {
+				log.Println("Error transforming data:", err)
+				continue
+			}
+			if output == nil {
+				// Every record was filtered out or is waiting in a window
+				continue
+			}
+			delivery.Add(1)
+			go func(index int, cfg Config, output []byte) {
+				defer delivery.Done()
+				if err := deliverOutput(sourceID, index, cfg, output); err != nil {
+					log.Println("Error delivering data:", err)
+					deliveryMu.Lock()
+					deliveryErr = err
+					deliveryMu.Unlock()
+				}
+			}(index, cfg, output)
+		}
+		delivery.Wait()
+		for position := range rejections.reasons {
+			undelivered[position] = true
+		}
+		return undelivered, deliveryErr
+	}
+
+	for position := range records {
+		undelivered[position] = true
+	}
+	return undelivered, nil
+}
+
+// deliverOutput sends transformed data to one destination of a source. Ordered
+// destinations return once every record left its lane.
+func deliverOutput(sourceID int, index int, cfg Config, output []byte) error {
+	if cfg.OrderingKey != "" {
+		// Records sharing a key are delivered in order, different keys in parallel
+		return dispatchOrdered(sourceID, index, cfg, output)
+	}
+	return publishToDestination(cfg, "", output)
+}
+
+// publishToDestination sends data to a single destination based on its type
+func publishToDestination(cfg Config, key string, data []byte) error {
+	switch cfg.Type {
+	case "API":
+		log.Println("HTTP output handler")
+		return publishDataToAPIs(cfg.URL, data)
+	case "FILE":
+		log.Println("File output handler")
+		return publishDataToFile(cfg.FilePath, data)
+	case "DB":
+		log.Println("Database output handler")
+		return errors.New("DB destinations cannot be written to")
+	case "KAFKA":
+		log.Println("Kafka output handler")
+		if cfg.SchemaRegistry != nil {
+			return publishRegisteredKafka(cfg, key, data)
 		}
+		return publishDataToKafka(cfg.IP, cfg.Port, cfg.TopicName, key, string(data))
+	default:
+		log.Println("Unknown output type")
+		return publishDataToAPIs(cfg.URL, data)
+	}
+}
+
+// ReadFile reads the JSON file of a source, or its CSV file when the source has the CSV
+// type or the file a .csv extension, and processes its records
+func ReadFile(sourceID int, config Config) {
+	jsonData, err := ioutil.ReadFile(config.FilePath)
+	if err != nil {
+		log.Println("Error reading file:", err)
+		return
+	}
+
+	if config.Type == "CSV" || strings.EqualFold(filepath.Ext(config.FilePath), ".csv") {
+		records, err := decodeCSVRecords(jsonData)
+		if err != nil {
+			log.Println("Error reading CSV file:", err)
+			return
+		}
+		jsonData, err = json.Marshal(records)
+		if err != nil {
+			log.Println("Error marshalling CSV records:", err)
+			return
+		}
+	}
+	if jsonData, ok := ingestData(sourceID, jsonData); ok {
+		processData(sourceID, jsonData)
+	}
+}
+
+// Kafka producers shared by the destinations of a broker, keyed by "ip:port"
+var kafkaProducers = make(map[string]sarama.SyncProducer)
+var kafkaProducersMu sync.Mutex
+
+// getKafkaProducer returns the producer of a broker, connecting on first use
+func getKafkaProducer(broker string) (sarama.SyncProducer, error) {
+	kafkaProducersMu.Lock()
+	defer kafkaProducersMu.Unlock()
+
+	if producer, exists := kafkaProducers[broker]; exists {
+		return producer, nil
 	}
+	producer, err := sarama.NewSyncProducer([]string{broker}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start Kafka producer for %s: %v", broker, err)
+	}
+	kafkaProducers[broker] = producer
+	return producer, nil
 }
 
-func ReadFile(sourceID int, fileName string) {
-	jsonData, _ := ioutil.ReadFile(fileName)
-	if config, ok := destinationConfig[sourceID]; ok {
-		outputInHighLevelTransform(config.TransformationConfig.OutputFormat)
-		respd, _ := TransformationINHighLevel(jsonData, finalOutputData, config.TransformationConfig.RuleType)
-		log.Println("Request succeeded with status 200", string(respd))
-		go processData(sourceID, respd)
+// discardKafkaProducer closes the producer of a broker after a failed send so that the
+// next message reconnects
+func discardKafkaProducer(broker string, producer sarama.SyncProducer) {
+	kafkaProducersMu.Lock()
+	if kafkaProducers[broker] == producer {
+		delete(kafkaProducers, broker)
 	}
+	kafkaProducersMu.Unlock()
+	producer.Close()
+}
+
+// publishDataToKafka sends data to a Kafka topic, using key for partitioning when set
+func publishDataToKafka(ip string, port string, topicName string, key string, data string) error {
+	return sendKafkaMessages(ip, port, topicName, key, [][]byte{[]byte(data)})
 }
 
-// publishDataToKafka sends data to a Kafka topic
-func publishDataToKafka(ip string, port string, topicName string, data string) {
-	producer, err := sarama.NewSyncProducer([]string{ip + ":" + port}, nil)
+// sendKafkaMessages sends several messages to a Kafka topic in a single batch
+func sendKafkaMessages(ip string, port string, topicName string, key string, values [][]byte) error {
+	broker := ip + ":" + port
+	producer, err := getKafkaProducer(broker)
 	if err != nil {
-		log.Fatal("Failed to start Kafka producer:", err)
+		return err
 	}
-	defer producer.Close()
 
-	// Create a Kafka message
-	message := &sarama.ProducerMessage{
-		Topic: topicName,
-		Value: sarama.StringEncoder(data),
+	// Create the Kafka messages
+	messages := make([]*sarama.ProducerMessage, 0, len(values))
+	for _, value := range values {
+		message := &sarama.ProducerMessage{
+			Topic: topicName,
+			Value: sarama.ByteEncoder(value),
+		}
+		if key != "" {
+			message.Key = sarama.StringEncoder(key)
+		}
+		messages = append(messages, message)
 	}
 
-	// Send the message to Kafka
-	partition, offset, err := producer.SendMessage(message)
+	// Send the messages to Kafka
+	if err := producer.SendMessages(messages); err != nil {
+		discardKafkaProducer(broker, producer)
+		return fmt.Errorf("cannot send to Kafka topic %s: %v", topicName, err)
+	}
+	for _, message := range messages {
+		log.Printf("Message sent to partition %d with offset %d", message.Partition, message.Offset)
+	}
+	return nil
+}
+
+// handleDatabaseInput reads a DB source every Duration, or once when it has none
+func handleDatabaseInput(sourceID int, connector int, config Config, stopChan chan bool) {
+	if config.Duration == "" {
+		handleDatabaseFetchData(sourceID, connector, config)
+		return
+	}
+
+	duration, err := parseDuration(config.Duration)
 	if err != nil {
-		log.Fatal("Failed to send message:", err)
+		log.Println(err)
+		return
 	}
 
-	log.Printf("Message sent to partition %d with offset %d", partition, offset)
+	for {
+		handleDatabaseFetchData(sourceID, connector, config)
+		select {
+		case <-time.After(duration):
+		case <-stopChan:
+			fmt.Printf("%s is stopping...\n", "DB")
+			return
+		}
+	}
 }
 
 // handleDatabaseFetchData fetches data from a database based on configuration
-func handleDatabaseFetchData(Source int, config Config) {
+func handleDatabaseFetchData(Source int, connector int, config Config) {
 	defer panicRecoveryMiddleware()
 
-	// Create DSN string for MySQL connection
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", config.DBUser, config.DBPassword, config.DBHost, config.DBPort, config.DBName)
+	dialect, err := dialectFor(config.DBType)
+	if err != nil {
+		log.Println("Error opening database:", err)
+		return
+	}
 
 	// Open the database connection
-	db, err := sql.Open("mysql", dsn)
+	db, err := sql.Open(dialect.driver, dialect.dsn(config))
 	if err != nil {
 		log.Println("Error opening database:", err)
 		return
@@ -372,73 +853,60 @@ func handleDatabaseFetchData(Source int, config Config) {
 		return
 	}
 
-	log.Println("Successfully connected to the MySQL database!")
+	log.Println("Successfully connected to the database!")
 
-	// Query the database
-	var version string
-	err = db.QueryRow("SELECT VERSION()").Scan(&version)
+	// Build the query with quoted identifiers and bound parameters
+	query, args, err := buildSourceQuery(dialect, config, sourceQueryParams(Source, connector, config))
 	if err != nil {
-		log.Println("Error querying database:", err)
+		log.Println("Error building query:", err)
 		return
 	}
-	log.Printf("MySQL version: %s", version)
 
-	rows, err := db.Query("SELECT * FROM " + config.TableName)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Println("Error querying database:", err)
 		return
 	}
 	defer rows.Close()
-	// Fetch rows
-	var allRows []map[string]interface{}
-	// Print rows
-	for rows.Next() {
-		columns, err := rows.Columns()
-		if err != nil {
-			log.Println("Error getting columns:", err)
-		}
-
-		// Make a slice for the values
-		values := make([]sql.RawBytes, len(columns))
-
-		// rows.Scan wants pointers to values, so we must copy
-		// the references into such a slice
-		// See http://go-database-sql.org/retrieving.html
-		scanArgs := make([]interface{}, len(values))
-		for i := range values {
-			scanArgs[i] = &values[i]
-		}
-
-		for rows.Next() {
-			err = rows.Scan(scanArgs...)
-			if err != nil {
-				log.Println("Error scanning row:", err)
-			}
-
-			row := make(map[string]interface{})
-			for i, col := range columns {
-				row[col] = string(values[i])
-			}
-			allRows = append(allRows, row)
-		}
 
+	// Decode every row with the types of its columns
+	allRows, err := scanRows(rows)
+	if err != nil {
+		log.Println("Error reading rows:", err)
+		return
 	}
+
 	// Marshal the data into JSON format
 	jsonData, err := json.Marshal(allRows)
 	if err != nil {
 		fmt.Println(err)
 	}
-	finalOutputData = make(map[string]interface{})
+	delivered := true
+	if jsonData, ok := ingestData(Source, jsonData); ok {
+		if jsonData, snapshot, changed := detectChanges(Source, connector, config, jsonData); changed {
+			// The snapshot is the reference of the next poll once its changes were delivered
+			if err := processData(Source, jsonData); err != nil {
+				log.Println("Changes will be sent again on the next poll:", err)
+				delivered = false
+			} else {
+				snapshot.commit()
+			}
+		}
+	}
 
-	sourceConfig := destinationConfig[Source]
-	outputInHighLevelTransform(sourceConfig.TransformationConfig.OutputFormat)
-	respd, _ := TransformationINHighLevel(jsonData, finalOutputData, sourceConfig.TransformationConfig.RuleType)
-	log.Println("Request succeeded with status 200", string(respd))
-	go processData(Source, respd)
+	// Continue after the rows read when the source uses a watermark, or read them again
+	// on the next poll when they could not be delivered
+	if config.WatermarkColumn != "" && delivered {
+		if err := saveWatermark(Source, connector, config.WatermarkColumn, allRows); err != nil {
+			log.Println("Failed to save watermark:", err)
+		}
+	}
 }
 
-// handleAPIInput makes an HTTP request based on the provided configuration
-func handleAPIInput(sourceID int, config Config, stopChan chan bool) {
+// handleAPIInput polls the URL of an API source and processes its responses, or their
+// changes in change detection mode, leaving out the records already delivered when
+// Dedup is configured
+func handleAPIInput(sourceID int, connector int, config Config, stopChan chan bool) {
 
 	// Parse the duration
 	duration, err := parseDuration(config.Duration)
@@ -447,6 +915,12 @@ func handleAPIInput(sourceID int, config Config, stopChan chan bool) {
 		return
 	}
 
+	dedup, err := newDeduplicator(sourceID, connector, config)
+	if err != nil {
+		log.Println("Failed to load dedup store:", err)
+		return
+	}
+
 	for {
 		resp, err := client.R().Get(config.URL)
 		if err != nil {
@@ -456,15 +930,28 @@ func handleAPIInput(sourceID int, config Config, stopChan chan bool) {
 
 		log.Println("Response:", string(resp.Body()))
 
-		finalOutputData = make(map[string]interface{})
-
 		if resp.StatusCode() == 200 {
 
-			if config, ok := destinationConfig[sourceID]; ok {
-				outputInHighLevelTransform(config.TransformationConfig.OutputFormat)
-				respd, _ := TransformationINHighLevel(resp.Body(), finalOutputData, config.TransformationConfig.RuleType)
-				log.Println("Request succeeded with status 200", string(respd))
-				go processData(sourceID, respd)
+			log.Println("Request succeeded with status 200")
+			data, changed := ingestData(sourceID, resp.Body())
+			var snapshot *pendingSnapshot
+			if changed {
+				data, snapshot, changed = detectChanges(sourceID, connector, config, data)
+			}
+			var pending []dedupPending
+			if changed && dedup != nil {
+				data, pending, changed = dedup.filter(data)
+			}
+			if changed {
+				// Records are only remembered as sent once every destination got them
+				undelivered, err := processRecords(sourceID, data)
+				if err != nil {
+					log.Println("Records will be sent again on the next poll:", err)
+				} else if dedup != nil {
+					dedup.commit(pending, undelivered)
+				} else {
+					snapshot.commit()
+				}
 			}
 		}
 		select {
@@ -482,24 +969,18 @@ func handleAPIInput(sourceID int, config Config, stopChan chan bool) {
 
 // publishDataToAPIs sends transformed data to an exrnal HTTP API
 func publishDataToAPIs(url string, data []byte) error {
-	// Marshal the data into JSON format
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
-
-	// Make an HTTP POST request to the external API
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	// Make an HTTP POST request to the external API, data already holds the JSON payload
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	// Check for successful response
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
 		log.Printf("Error response from API: %s", string(bodyBytes))
-		return err
+		return fmt.Errorf("API %s returned %s", url, resp.Status)
 	}
 
 	return nil
@@ -519,214 +1000,161 @@ func panicRecoveryMiddleware() {
 	}()
 }
 
-func TransformationINHighLevel(input interface{}, output interface{}, ruleType string) ([]byte, error) {
-	// Check the type of the input
-	switch v := input.(type) {
-	case string:
-		// If the input is a string, check if it's valid JSON
-		var jsonData map[string]interface{}
-		if err := json.Unmarshal([]byte(v), &jsonData); err == nil {
-			// If it's valid JSON, return as it is
-			return json.Marshal(jsonData)
-		}
-		// If it's not valid JSON, return it as plain text in JSON
-		return json.Marshal(map[string]interface{}{
-			"data": v,
-		})
-
-	case []byte:
-		var err error
-		var data [][]interface{}
-		if err = json.Unmarshal([]byte(v), &data); err == nil {
-			header := data[0]
-			userData := data[1:]
-			// If the input is a JSON array, check if it's valid JSON
-			finalDataOutputList := make([]map[string]interface{}, 0)
-			// value, err := gval.Evaluate(ruleType,
-			// 	item)
-			// if err != nil {
-			// 	fmt.Println(err)
-			// }
-			if ruleType == "" {
-
-				for _, value := range userData {
-					reslutData := finalOutputData
-					for keyData, _key := range reslutData {
-
-						for index, _value := range header {
-							if strings.Contains(_key.(string), _value.(string)) {
-
-								reslutData[keyData] = value[index]
-							}
-						}
+// TransformationINHighLevel applies the transformation to decoded records and returns
+// the kept records as JSON together with the rejected ones. A single JSON object in gives
+// a single object out, and nil is returned when every record was filtered out.
+func TransformationINHighLevel(scope pipelineScope, records []map[string]interface{}, single bool, transformation finalOutputDataJSON) ([]byte, []recordError, error) {
+	result := transformRecordsIn(&scope, records, transformation)
 
-					}
-					finalDataOutputList = append(finalDataOutputList, reslutData)
-				}
-			}
-		} else {
-
-			// If the input is a string, check if it's valid JSON
-			var jsonData map[string]interface{}
-
-			if err = json.Unmarshal([]byte(v), &jsonData); err == nil {
-				value, err := gval.Evaluate(ruleType,
-					jsonData)
-				if err != nil {
-					fmt.Println(err)
-				}
-				if value == true || ruleType == "" {
-					reslutData := finalOutputData
-					for keyData, valueType := range reslutData {
-
-						for key, value := range jsonData {
-
-							if strings.Contains(valueType.(string), key) {
-								reslutData[keyData] = value
-							}
-							fmt.Println("key", key, value)
-						}
-					}
-					// If it's valid JSON, return as it is
-					return json.Marshal(reslutData)
-				}
-			}
-			if strings.Contains(err.Error(), "cannot unmarshal array") {
-				// If it's not valid JSON, return it as plain text in JSON
-				var jsonArrayData []map[string]interface{}
-				if err = json.Unmarshal([]byte(v), &jsonArrayData); err == nil {
-					var finalDataOutputList []map[string]interface{}
-
-					for _, item := range jsonArrayData {
-						value, err := gval.Evaluate(ruleType,
-							item)
-						if err != nil {
-							fmt.Println(err)
-						}
-						if value == true || ruleType == "" {
-							reslutData := finalOutputData
-							for keyData, valueType := range reslutData {
-
-								for key, value := range item {
-									if strings.Contains(valueType.(string), key) {
-
-										reslutData[keyData] = value
-
-									}
-									fmt.Println("key", key, value)
-								}
-								finalDataOutputList = append(finalDataOutputList, reslutData)
-							}
-						}
-					}
+	if len(result.Records) == 0 {
+		return nil, result.Errors, nil
+	}
+	var output []byte
+	var err error
+	if single && len(result.Records) == 1 {
+		output, err = json.Marshal(result.Records[0])
+	} else {
+		output, err = json.Marshal(result.Records)
+	}
+	return output, result.Errors, err
+}
 
-					return json.Marshal(finalDataOutputList)
-				}
+// outputInHighLevelTransform builds an output record from a source record using the
+// output format, converting every value to its KeyType and building nested structures
+func outputInHighLevelTransform(outputData []outputRuleStructure, record map[string]interface{}) (map[string]interface{}, error) {
+	output := make(map[string]interface{}, len(outputData))
+	for _, data := range outputData {
+		var value interface{}
+		var err error
+		switch {
+		case data.Rule != "":
+			// The rule computes the value from the whole source record
+			value, err = evaluateExpression(data.Rule, record)
+			if err != nil {
+				value, err = fieldFailure(data, err)
+			} else {
+				value, err = convertField(value, data)
 			}
-			fmt.Println("JSON Output (Binary Data Input):", err)
-			return nil, nil
+		case data.KeyType == "STRUCT" && len(data.Structure) > 0:
+			value, err = structField(record, data)
+		case data.KeyType == "ARRAY_STRUCT" && len(data.Structure) > 0:
+			value, err = arrayStructField(record, data)
+		default:
+			value, err = convertField(sourceValue(record, data.Key), data)
 		}
-
-	default:
-		// If the input is another type, try converting it into a JSON-friendly format
-		return json.Marshal(map[string]interface{}{
-			"data": fmt.Sprintf("Unsupported type: %v", reflect.TypeOf(input)),
-		})
+		if err != nil {
+			return nil, err
+		}
+		output[data.DisplayName] = maskField(value, data)
 	}
-	return nil, nil
+	return output, nil
 }
 
-func outputInHighLevelTransform(outputData []outputRuleStructure) map[string]interface{} {
-
-	fmt.Println(outputData, "outputData")
-	for _, data := range outputData {
-		switch data.KeyType {
-		case "STRING":
-			finalOutputData[data.DisplayName] = data.Key
-		case "INT":
-			finalOutputData[data.DisplayName] = data.Key
-		case "ARRAY_STRING":
-			finalOutputData[data.DisplayName] = data.Key
-		case "ARRAY_INT":
-			finalOutputData[data.DisplayName] = data.Key
-		case "ARRAY_STRUCT":
-			var aryaInputMap []map[string]interface{}
-			aryaInputMap = append(aryaInputMap, outputInHighLevelTransform(data.Structure))
-			finalOutputData[data.DisplayName] = data.Key
-		case "STRUCT":
-			finalOutputData[data.DisplayName] = data.Key
-		}
-	}
-	return finalOutputData
+// sourceValue returns the value of the first candidate of the comma separated key list
+// found in the record. A candidate matches a top level key exactly, otherwise it is
+// resolved as a path such as "customer.address.city" or "items[0].sku".
+func sourceValue(record map[string]interface{}, keyList string) interface{} {
+	for _, candidate := range sourceKeyCandidates(keyList) {
+		if value, exists := record[candidate]; exists {
+			return value
+		}
+		if value, ok := lookupPath(record, candidate); ok {
+			return value
+		}
+	}
+	return nil
 }
+
+// evaluateComplexRule evaluates a declarative expression such as
+// "Country == USA && CustomerID >= 10 || Email exists". && binds tighter than ||, and
+// both are literal inside quoted values such as Name == "Tom && Jerry".
 func evaluateComplexRule(data map[string]interface{}, expression string) (bool, error) {
-	// Split the expression into individual conditions (for simplicity)
-	conditions := strings.Split(expression, "&&")
+	for _, alternative := range splitOutsideQuotes(expression, "||") {
+		matched := true
 
-	// Process each condition
-	for _, condition := range conditions {
-		condition = strings.TrimSpace(condition)
-		// Each condition will be in the form of "key operator value"
-		parts := strings.Fields(condition)
-		if len(parts) != 3 {
-			return false, fmt.Errorf("invalid condition: %s", condition)
-		}
+		// Split the alternative into individual conditions
+		for _, condition := range splitOutsideQuotes(alternative, "&&") {
+			rule, err := parseCondition(condition)
+			if err != nil {
+				return false, err
+			}
 
-		key, operator, value := parts[0], parts[1], parts[2]
-		rule := Rule{Key: key, Op: operator, Value: value}
+			// Evaluate the individual rule
+			result, err := evaluateRule(data, rule)
+			if err != nil {
+				return false, err
+			}
 
-		// Evaluate the individual rule
-		result, err := evaluateRule(data, rule)
-		if err != nil {
-			return false, err
+			// If any condition is false, the whole alternative is false
+			if !result {
+				matched = false
+				break
+			}
 		}
 
-		// If any condition is false, the entire expression is false
-		if !result {
-			return false, nil
+		if matched {
+			return true, nil
 		}
 	}
 
-	return true, nil
+	return false, nil
 }
 
 // Function to evaluate rules
 func evaluateRule(data map[string]interface{}, rule Rule) (bool, error) {
 	// Get the value from the data map
-	value, exists := data[rule.Key]
+	value, exists := ruleValue(data, rule.Key)
+
+	// Apply the operator
+	switch strings.ToLower(rule.Op) {
+	case "exists":
+		return exists && value != nil, nil
+	case "not_exists":
+		return !exists || value == nil, nil
+	}
 	if !exists {
-		return false, fmt.Errorf("key %s not found in data", rule.Key)
+		// A missing key never matches a comparison
+		return false, nil
 	}
 
-	// Apply the operator
-	switch rule.Op {
-	case "==":
-		// Check equality
-		return value == rule.Value, nil
+	switch strings.ToLower(rule.Op) {
+	case "==", "=":
+		// Check equality, numeric strings compare as numbers
+		return compareValues(value, rule.Value) == 0, nil
+	case "!=":
+		return compareValues(value, rule.Value) != 0, nil
 	case ">":
-		// Check greater than for numeric values
-		if v, ok := value.(float64); ok {
-			if val, ok := rule.Value.(float64); ok {
-				return v > val, nil
-			}
-		}
-		return false, fmt.Errorf("invalid comparison for >")
+		return orderedComparison(value, rule, func(c int) bool { return c > 0 })
+	case ">=":
+		return orderedComparison(value, rule, func(c int) bool { return c >= 0 })
 	case "<":
-		// Check less than for numeric values
-		if v, ok := value.(float64); ok {
-			if val, ok := rule.Value.(float64); ok {
-				return v < val, nil
-			}
-		}
-		return false, fmt.Errorf("invalid comparison for <")
+		return orderedComparison(value, rule, func(c int) bool { return c < 0 })
+	case "<=":
+		return orderedComparison(value, rule, func(c int) bool { return c <= 0 })
 	case "contains":
 		// Check if a string contains another string
-		if v, ok := value.(string); ok {
-			if val, ok := rule.Value.(string); ok {
-				return strings.Contains(v, val), nil
+		return strings.Contains(toString(value), toString(rule.Value)), nil
+	case "in", "not_in":
+		found := false
+		for _, candidate := range ruleValues(rule.Value) {
+			if compareValues(value, candidate) == 0 {
+				found = true
+				break
 			}
 		}
-		return false, fmt.Errorf("invalid comparison for contains")
+		return found == (strings.ToLower(rule.Op) == "in"), nil
+	case "regex":
+		pattern, err := compileRulePattern(toString(rule.Value))
+		if err != nil {
+			return false, err
+		}
+		return pattern.MatchString(toString(value)), nil
+	case "between":
+		bounds := ruleValues(rule.Value)
+		if len(bounds) != 2 {
+			return false, fmt.Errorf("between expects two bounds for %s", rule.Key)
+		}
+		return compareValues(value, bounds[0]) >= 0 && compareValues(value, bounds[1]) <= 0, nil
 	default:
 		return false, fmt.Errorf("unsupported operator %s", rule.Op)
 	}
@@ -742,12 +1170,76 @@ func parseDuration(flag string) (time.Duration, error) {
 	return duration, nil
 }
 
-// Function to stop a worker by name (closes the stop channel)
-func stopWorker(name string) {
+// WorkerNotFoundError is returned with HTTP 404 when a connector has no running worker
+type WorkerNotFoundError struct {
+	Source    int
+	Connector int
+}
+
+func (e WorkerNotFoundError) Error() string {
+	return fmt.Sprintf("no worker is running for connector %d of source %d", e.Connector, e.Source)
+}
+
+// StatusCode makes GoFr respond with 404 Not Found
+func (e WorkerNotFoundError) StatusCode() int {
+	return http.StatusNotFound
+}
+
+// stopWorkerHandler stops the running worker of the connector at index "connector" of
+// the source "source"
+func stopWorkerHandler(c *gofr.Context) (interface{}, error) {
+	defer panicRecoveryMiddleware()
+
+	sourceID, err := strconv.Atoi(c.Param("source"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q", c.Param("source"))
+	}
+	connector, err := strconv.Atoi(c.Param("connector"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid connector %q", c.Param("connector"))
+	}
+
+	name := workerName(sourceID, connector)
+	mu.Lock()
+	_, running := stopChannels[name]
+	mu.Unlock()
+	if !running {
+		return nil, WorkerNotFoundError{Source: sourceID, Connector: connector}
+	}
+
+	retireWorker(name)
+	log.Println("Worker stopped:", name)
+	return "STOPPED", nil
+}
+
+// workerName identifies the worker of a connector by its source and its index
+func workerName(sourceID int, connector int) string {
+	return fmt.Sprintf("%d-%d", sourceID, connector)
+}
+
+// retireWorker stops a worker for good: a CDC worker also drops its replication slot
+func retireWorker(name string) {
 	mu.Lock()
 	defer mu.Unlock()
 	if stopChan, exists := stopChannels[name]; exists {
+		stopChan <- true
+		close(stopChan)
+		delete(stopChannels, name)
+		delete(cdcSlots, name)
+	}
+}
+
+// stopAllWorkers stops the workers of every source. CDC workers whose slot is not in
+// keptSlots are retired.
+func stopAllWorkers(keptSlots map[string]bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for name, stopChan := range stopChannels {
+		if slot, isCDC := cdcSlots[name]; isCDC && !keptSlots[slot] {
+			stopChan <- true
+		}
 		close(stopChan)
 		delete(stopChannels, name)
+		delete(cdcSlots, name)
 	}
 }
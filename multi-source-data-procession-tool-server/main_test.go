@@ -0,0 +1,25 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublishDataToAPIsSendsPayload(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+	defer server.Close()
+
+	payload := `[{"id":1,"name":"Ada"}]`
+	if err := publishDataToAPIs(server.URL, []byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if received != payload {
+		t.Errorf("API received %q, want %q", received, payload)
+	}
+}
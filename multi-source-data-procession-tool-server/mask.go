@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"unicode"
+)
+
+// Masking options of an output field
+const (
+	maskRedact   = "REDACT"
+	maskPartial  = "PARTIAL"
+	maskHash     = "HASH"
+	maskTokenize = "TOKENIZE"
+)
+
+// Value of the redacted fields
+const redactedValue = "[REDACTED]"
+
+// Number of trailing characters a PARTIAL mask leaves visible by default
+const defaultMaskKeep = 4
+
+// Masking options accepted in OutputFormat entries
+var supportedMasks = map[string]bool{
+	"":           true,
+	maskRedact:   true,
+	maskPartial:  true,
+	maskHash:     true,
+	maskTokenize: true,
+}
+
+// maskField applies the Mask of an output field to its converted value. Arrays are
+// masked element by element, null values stay null.
+func maskField(value interface{}, output outputRuleStructure) interface{} {
+	if value == nil || output.Mask == "" {
+		return value
+	}
+	if items, ok := value.([]interface{}); ok {
+		masked := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			masked = append(masked, maskField(item, output))
+		}
+		return masked
+	}
+
+	text := toString(value)
+	switch strings.ToUpper(output.Mask) {
+	case maskRedact:
+		return redactedValue
+	case maskPartial:
+		keep := defaultMaskKeep
+		if output.MaskKeep != nil {
+			keep = *output.MaskKeep
+		}
+		return partialMask(text, keep)
+	case maskHash:
+		return keyedHash(text, output.Salt)
+	case maskTokenize:
+		return tokenize(text, output.Salt)
+	default:
+		return value
+	}
+}
+
+// partialMask replaces every character but the last keep ones with "*". Values not
+// longer than keep are masked entirely.
+func partialMask(text string, keep int) string {
+	runes := []rune(text)
+	hidden := len(runes) - keep
+	if hidden <= 0 {
+		hidden = len(runes)
+	}
+	for i := 0; i < hidden; i++ {
+		runes[i] = '*'
+	}
+	return string(runes)
+}
+
+// keyedHash returns the hex encoded HMAC-SHA256 of the text keyed with the salt. Unlike
+// a plain salted hash, low entropy values such as phone numbers cannot be recovered by
+// hashing every candidate without knowing the salt.
+func keyedHash(text string, salt string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tokenize replaces digits by digits and letters by letters of the same case, keeping
+// every other character, so the token has the format of the value. Tokens are derived
+// from an HMAC-SHA256 keyed with the salt: equal values give equal tokens, which keeps
+// them usable as join keys, but a token cannot be turned back into its value.
+func tokenize(text string, salt string) string {
+	runes := []rune(text)
+	stream := tokenStream(text, salt, len(runes))
+	for i, r := range runes {
+		switch {
+		case r >= '0' && r <= '9':
+			runes[i] = '0' + rune(stream[i]%10)
+		case unicode.IsUpper(r) && r <= unicode.MaxASCII:
+			runes[i] = 'A' + rune(stream[i]%26)
+		case unicode.IsLower(r) && r <= unicode.MaxASCII:
+			runes[i] = 'a' + rune(stream[i]%26)
+		}
+	}
+	return string(runes)
+}
+
+// tokenStream returns length pseudo random bytes derived from the text and the salt
+func tokenStream(text string, salt string, length int) []byte {
+	stream := make([]byte, 0, length+sha256.Size)
+	counter := make([]byte, 4)
+	for block := uint32(0); len(stream) < length; block++ {
+		mac := hmac.New(sha256.New, []byte(salt))
+		binary.BigEndian.PutUint32(counter, block)
+		mac.Write(counter)
+		mac.Write([]byte(text))
+		stream = mac.Sum(stream)
+	}
+	return stream
+}
+
+// validateMask checks the masking options of an output field
+func validateMask(errs *ValidationErrors, field string, output outputRuleStructure) {
+	mask := strings.ToUpper(output.Mask)
+	if !supportedMasks[mask] {
+		errs.add(field+".Mask", "must be REDACT, PARTIAL, HASH or TOKENIZE")
+		return
+	}
+	if mask == "" {
+		return
+	}
+	if output.KeyType == "STRUCT" || output.KeyType == "ARRAY_STRUCT" {
+		errs.add(field+".Mask", "cannot mask %s fields, mask their nested fields instead", output.KeyType)
+	}
+	if output.MaskKeep != nil && *output.MaskKeep < 0 {
+		errs.add(field+".MaskKeep", "must not be negative")
+	}
+	if (mask == maskHash || mask == maskTokenize) && output.Salt == "" {
+		errs.add(field+".Salt", "is required for %s", mask)
+	}
+}
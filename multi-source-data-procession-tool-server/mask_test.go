@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestMaskField(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		output outputRuleStructure
+		want   interface{}
+	}{
+		{name: "redact", value: "secret", output: outputRuleStructure{Mask: "REDACT"}, want: redactedValue},
+		{name: "partial", value: "4111111111111111", output: outputRuleStructure{Mask: "PARTIAL"}, want: "************1111"},
+		{name: "partial short", value: "abc", output: outputRuleStructure{Mask: "PARTIAL"}, want: "***"},
+		// HMAC-SHA256 of "The quick brown fox jumps over the lazy dog" keyed with "key"
+		{name: "hash", value: "The quick brown fox jumps over the lazy dog", output: outputRuleStructure{Mask: "HASH", Salt: "key"}, want: "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{name: "null", value: nil, output: outputRuleStructure{Mask: "HASH", Salt: "key"}, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := maskField(test.value, test.output); got != test.want {
+				t.Errorf("maskField(%v) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenizeKeepsFormat(t *testing.T) {
+	token := tokenize("AB-1234-cd", "key")
+	if token == "AB-1234-cd" || len(token) != len("AB-1234-cd") || token[2] != '-' || token[7] != '-' {
+		t.Errorf("tokenize = %q, want a token with the format of the value", token)
+	}
+	if tokenize("AB-1234-cd", "key") != token {
+		t.Error("tokenize is not deterministic")
+	}
+	if tokenize("AB-1234-cd", "other") == token {
+		t.Error("tokenize does not depend on the key")
+	}
+}
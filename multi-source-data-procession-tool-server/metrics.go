@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+)
+
+// Counters exposed on the GoFr metrics endpoint
+const (
+	metricSchemaRejected = "schema_rejected_records_total"
+)
+
+// metricsManager is the part of the GoFr metrics manager used by the pipelines
+type metricsManager interface {
+	NewCounter(name, desc string)
+	IncrementCounter(ctx context.Context, name string, labels ...string)
+}
+
+// Metrics manager of the running app, nil until registerMetrics is called
+var appMetrics metricsManager
+
+// registerMetrics creates the counters of the pipelines
+func registerMetrics(manager metricsManager) {
+	if manager == nil {
+		return
+	}
+	manager.NewCounter(metricSchemaRejected, "Number of records rejected by the JSON Schema of their source")
+	appMetrics = manager
+}
+
+// incrementCounter increments a counter when metrics are registered
+func incrementCounter(name string, labels ...string) {
+	if appMetrics == nil {
+		return
+	}
+	appMetrics.IncrementCounter(context.Background(), name, labels...)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Default number of ordered lanes per destination when OrderingWorkers is not set
+const defaultOrderingWorkers = 8
+
+// Size of the queue in front of each ordered lane
+const orderedLaneBuffer = 256
+
+// orderedDispatcher delivers records to a single destination, keeping records that
+// share an ordering key in arrival order while different keys run in parallel
+type orderedDispatcher struct {
+	config Config
+	lanes  []chan orderedRecord
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+// orderedRecord is a single record waiting in a lane together with its ordering key.
+// The result of its delivery is sent to done.
+type orderedRecord struct {
+	key  string
+	data []byte
+	done chan error
+}
+
+// Global map of ordered dispatchers keyed by source and destination index
+var orderedDispatchers = make(map[string]*orderedDispatcher)
+var orderedMu sync.Mutex
+
+// newOrderedDispatcher starts one goroutine per lane for the given destination
+func newOrderedDispatcher(config Config) *orderedDispatcher {
+	workers := config.OrderingWorkers
+	if workers <= 0 {
+		workers = defaultOrderingWorkers
+	}
+
+	dispatcher := &orderedDispatcher{
+		config: config,
+		lanes:  make([]chan orderedRecord, workers),
+		quit:   make(chan struct{}),
+	}
+	for i := range dispatcher.lanes {
+		lane := make(chan orderedRecord, orderedLaneBuffer)
+		dispatcher.lanes[i] = lane
+		dispatcher.wg.Add(1)
+		go func() {
+			defer dispatcher.wg.Done()
+			// Records in a lane are delivered one at a time, in the order they were queued
+			for {
+				select {
+				case record := <-lane:
+					dispatcher.deliver(record)
+				case <-dispatcher.quit:
+					dispatcher.drain(lane)
+					return
+				}
+			}
+		}()
+	}
+	return dispatcher
+}
+
+// drain delivers every record left in a lane of a closed dispatcher. No record can be
+// queued once the dispatcher is closed, so the lane only gets shorter.
+func (d *orderedDispatcher) drain(lane chan orderedRecord) {
+	if len(lane) > 0 {
+		log.Println("Delivering records queued before redeploy:", len(lane))
+	}
+	for {
+		select {
+		case record := <-lane:
+			d.deliver(record)
+		default:
+			return
+		}
+	}
+}
+
+// deliver sends a record to the destination and reports the result to its sender
+func (d *orderedDispatcher) deliver(record orderedRecord) {
+	err := publishToDestination(d.config, record.key, record.data)
+	if err != nil {
+		log.Println("Error delivering ordered record:", err)
+	}
+	record.done <- err
+}
+
+// enqueue routes a record to the lane owning its ordering key and returns false when
+// the dispatcher is closed. The record is queued under the read lock, so close waits for
+// it and drains it. A full lane blocks the caller until its goroutine makes room.
+func (d *orderedDispatcher) enqueue(record orderedRecord) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(record.key))
+	d.lanes[hash.Sum32()%uint32(len(d.lanes))] <- record
+	return true
+}
+
+// close stops accepting records and waits for the queued ones to be delivered
+func (d *orderedDispatcher) close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	close(d.quit)
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// getOrderedDispatcher returns the dispatcher for a destination, creating it on first use
+func getOrderedDispatcher(sourceID int, index int, config Config) *orderedDispatcher {
+	name := fmt.Sprintf("%d/%d", sourceID, index)
+
+	orderedMu.Lock()
+	defer orderedMu.Unlock()
+	dispatcher, exists := orderedDispatchers[name]
+	if !exists {
+		dispatcher = newOrderedDispatcher(config)
+		orderedDispatchers[name] = dispatcher
+	}
+	return dispatcher
+}
+
+// resetOrderedDispatchers removes every dispatcher of a source so that a redeployed
+// destination configuration starts with fresh lanes. The old lanes are drained before
+// the lock is released, so a record never overtakes an older record with the same key
+// that is still queued for the previous deployment.
+func resetOrderedDispatchers(sourceID int) {
+	prefix := fmt.Sprintf("%d/", sourceID)
+
+	orderedMu.Lock()
+	defer orderedMu.Unlock()
+	for name, dispatcher := range orderedDispatchers {
+		if strings.HasPrefix(name, prefix) {
+			dispatcher.close()
+			delete(orderedDispatchers, name)
+		}
+	}
+}
+
+// dispatchOrdered splits a payload into records, queues each one by its ordering key and
+// waits until all of them were delivered. The error is the last delivery that failed.
+func dispatchOrdered(sourceID int, index int, config Config, data []byte) error {
+	records, _, err := decodeRecords(data)
+	if err != nil {
+		// Payloads that are not JSON records share a single lane
+		log.Println("Ordering key not found, payload is not a JSON record:", err)
+		return <-enqueueOrdered(sourceID, index, config, "", data)
+	}
+
+	var lastErr error
+	results := make([]chan error, 0, len(records))
+	for _, record := range records {
+		recordData, err := json.Marshal(record)
+		if err != nil {
+			log.Println("Error marshalling record:", err)
+			lastErr = err
+			continue
+		}
+		results = append(results, enqueueOrdered(sourceID, index, config, orderingKeyValue(record, config.OrderingKey), recordData))
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// enqueueOrdered queues a record with the current dispatcher of a destination and returns
+// the channel receiving the result of its delivery. A dispatcher closed by a redeploy has
+// been drained, so the record goes to its successor.
+func enqueueOrdered(sourceID int, index int, config Config, key string, data []byte) chan error {
+	record := orderedRecord{key: key, data: data, done: make(chan error, 1)}
+	for !getOrderedDispatcher(sourceID, index, config).enqueue(record) {
+	}
+	return record.done
+}
+
+// orderingKeyValue returns the partition key of a record as a string
+func orderingKeyValue(record map[string]interface{}, key string) string {
+	value, exists := record[key]
+	if !exists || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResetOrderedDispatchersDrainsInOrder(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "ordered.json")
+	config := Config{Type: "FILE", FilePath: output, OrderingKey: "CustomerID", OrderingWorkers: 2}
+
+	// The first half is queued for the previous deployment, the second for its successor
+	for sequence := 0; sequence < 200; sequence++ {
+		record, _ := json.Marshal(map[string]interface{}{"CustomerID": "c1", "Sequence": sequence})
+		dispatchOrdered(1, 0, config, record)
+		if sequence == 99 {
+			resetOrderedDispatchers(1)
+		}
+	}
+	resetOrderedDispatchers(1)
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 200 {
+		t.Fatalf("delivered %d records, want 200", len(lines))
+	}
+	for i, line := range lines {
+		var record struct{ Sequence int }
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Sequence != i {
+			t.Fatalf("record %d has sequence %d, want records in the order they were queued", i, record.Sequence)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is one step of a field path: an object key, an array index or a wildcard
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Parsed paths, keyed by their text, so records of a batch share the parsing work
+var parsedPaths = newBoundedCache(compiledCacheSize)
+
+// parsePath splits a path such as "customer.address.city", "items[0].sku",
+// "items[*].sku" or "$.orders[-1].id" into segments
+func parsePath(path string) ([]pathSegment, error) {
+	if cached, ok := parsedPaths.get(path); ok {
+		return cached.([]pathSegment), nil
+	}
+
+	text := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if text == "" {
+		return nil, fmt.Errorf("empty path %q", path)
+	}
+
+	var segments []pathSegment
+	for _, part := range strings.Split(text, ".") {
+		name := part
+		var brackets string
+		if open := strings.Index(part, "["); open >= 0 {
+			name, brackets = part[:open], part[open:]
+		}
+
+		switch name {
+		case "":
+			if brackets == "" {
+				return nil, fmt.Errorf("empty segment in path %q", path)
+			}
+		case "*":
+			segments = append(segments, pathSegment{wildcard: true})
+		default:
+			segments = append(segments, pathSegment{key: name})
+		}
+
+		for brackets != "" {
+			end := strings.Index(brackets, "]")
+			if !strings.HasPrefix(brackets, "[") || end < 0 {
+				return nil, fmt.Errorf("unbalanced brackets in path %q", path)
+			}
+			selector := strings.TrimSpace(brackets[1:end])
+			brackets = brackets[end+1:]
+
+			if selector == "*" {
+				segments = append(segments, pathSegment{wildcard: true})
+				continue
+			}
+			index, err := strconv.Atoi(selector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q in path %q", selector, path)
+			}
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+		}
+	}
+
+	parsedPaths.add(path, segments)
+	return segments, nil
+}
+
+// lookupPath resolves a path in a record. Paths containing a wildcard return the list
+// of every value they reach, the members of an object in the order of their keys.
+func lookupPath(record map[string]interface{}, path string) (interface{}, bool) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	hasWildcard := false
+	for _, segment := range segments {
+		hasWildcard = hasWildcard || segment.wildcard
+	}
+
+	values := resolveSegments(record, segments)
+	if hasWildcard {
+		return values, len(values) > 0
+	}
+	if len(values) == 0 {
+		return nil, false
+	}
+	return values[0], true
+}
+
+// resolveSegments walks the segments from value and returns every value reached
+func resolveSegments(value interface{}, segments []pathSegment) []interface{} {
+	if len(segments) == 0 {
+		return []interface{}{value}
+	}
+	segment, rest := segments[0], segments[1:]
+
+	switch {
+	case segment.wildcard:
+		var values []interface{}
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				values = append(values, resolveSegments(item, rest)...)
+			}
+		case map[string]interface{}:
+			// Object members are visited by key so that the result does not change between runs
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				values = append(values, resolveSegments(v[key], rest)...)
+			}
+		}
+		return values
+	case segment.isIndex:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		index := segment.index
+		if index < 0 {
+			index += len(items)
+		}
+		if index < 0 || index >= len(items) {
+			return nil
+		}
+		return resolveSegments(items[index], rest)
+	default:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		item, exists := object[segment.key]
+		if !exists {
+			return nil
+		}
+		return resolveSegments(item, rest)
+	}
+}
+
+// sourceKeyCandidates splits the comma separated Key of an output field
+func sourceKeyCandidates(keyList string) []string {
+	var candidates []string
+	for _, candidate := range strings.Split(keyList, ",") {
+		if candidate = strings.TrimSpace(candidate); candidate != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []pathSegment
+		wantErr bool
+	}{
+		{path: "name", want: []pathSegment{{key: "name"}}},
+		{path: "$.customer.city", want: []pathSegment{{key: "customer"}, {key: "city"}}},
+		{path: "items[0].sku", want: []pathSegment{{key: "items"}, {index: 0, isIndex: true}, {key: "sku"}}},
+		{path: "orders[-1]", want: []pathSegment{{key: "orders"}, {index: -1, isIndex: true}}},
+		{path: "items[*].tags[*]", want: []pathSegment{{key: "items"}, {wildcard: true}, {key: "tags"}, {wildcard: true}}},
+		{path: "*.id", want: []pathSegment{{wildcard: true}, {key: "id"}}},
+		{path: "matrix[1][2]", want: []pathSegment{{key: "matrix"}, {index: 1, isIndex: true}, {index: 2, isIndex: true}}},
+		{path: "$", wantErr: true},
+		{path: "a..b", wantErr: true},
+		{path: "items[0", wantErr: true},
+		{path: "items[x]", wantErr: true},
+	}
+
+	for _, test := range tests {
+		segments, err := parsePath(test.path)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parsePath(%q) error = %v, want error %v", test.path, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(segments, test.want) {
+			t.Errorf("parsePath(%q) = %+v, want %+v", test.path, segments, test.want)
+		}
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	record := map[string]interface{}{
+		"customer": map[string]interface{}{"city": "Paris"},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "A"},
+			map[string]interface{}{"sku": "B"},
+		},
+		"totals": map[string]interface{}{"b": 2.0, "a": 1.0, "c": 3.0},
+	}
+
+	tests := []struct {
+		path      string
+		want      interface{}
+		wantFound bool
+	}{
+		{path: "customer.city", want: "Paris", wantFound: true},
+		{path: "items[1].sku", want: "B", wantFound: true},
+		{path: "items[-1].sku", want: "B", wantFound: true},
+		{path: "items[*].sku", want: []interface{}{"A", "B"}, wantFound: true},
+		// Object members are visited in key order
+		{path: "totals[*]", want: []interface{}{1.0, 2.0, 3.0}, wantFound: true},
+		{path: "items[5].sku"},
+		{path: "customer.zip"},
+		{path: "items[*].missing", want: []interface{}(nil)},
+	}
+
+	for _, test := range tests {
+		value, found := lookupPath(record, test.path)
+		if found != test.wantFound || !reflect.DeepEqual(value, test.want) {
+			t.Errorf("lookupPath(%q) = %#v, %v, want %#v, %v", test.path, value, found, test.want, test.wantFound)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Step types of a transformation pipeline
+const (
+	stepFilter      = "FILTER"
+	stepMap         = "MAP"
+	stepRename      = "RENAME"
+	stepDrop        = "DROP"
+	stepFlatten     = "FLATTEN"
+	stepExplode     = "EXPLODE"
+	stepDeduplicate = "DEDUPLICATE"
+	stepDefault     = "DEFAULT"
+	stepLookup      = "LOOKUP"
+)
+
+// TransformationStep is one step of a transformation pipeline. Only the fields used
+// by its Type are read.
+type TransformationStep struct {
+	Type string `yaml:"Type" json:"Type"`
+
+	// FILTER keeps the records matching RuleType and Filter
+	RuleType   string       `yaml:"RuleType,omitempty" json:"RuleType,omitempty"`
+	FilterType string       `yaml:"FilterType,omitempty" json:"FilterType,omitempty"`
+	Filter     *FilterGroup `yaml:"Filter,omitempty" json:"Filter,omitempty"`
+
+	// MAP builds new records from OutputFormat
+	OutputFormat []outputRuleStructure `yaml:"OutputFormat,omitempty" json:"OutputFormat,omitempty"`
+
+	// RENAME renames fields, old name to new name, in the order they are written
+	Rename renameList `yaml:"Rename,omitempty" json:"Rename,omitempty"`
+
+	// DROP removes Fields, FLATTEN flattens Fields (every object when empty),
+	// DEDUPLICATE compares Fields (the whole record when empty) and LOOKUP with
+	// FromSource copies Fields (every field when empty)
+	Fields    []string `yaml:"Fields,omitempty" json:"Fields,omitempty"`
+	Separator string   `yaml:"Separator,omitempty" json:"Separator,omitempty"`
+
+	// EXPLODE emits one record per element of the array at Field, stored under As.
+	// LOOKUP replaces Field through Table, storing the result under Target.
+	Field  string                 `yaml:"Field,omitempty" json:"Field,omitempty"`
+	As     string                 `yaml:"As,omitempty" json:"As,omitempty"`
+	Table  map[string]interface{} `yaml:"Table,omitempty" json:"Table,omitempty"`
+	Target string                 `yaml:"Target,omitempty" json:"Target,omitempty"`
+
+	// LOOKUP with FromSource enriches Field from the latest records of another source,
+	// matched on its On field (Field when empty) and limited to Fields when set.
+	// LookupMode is SNAPSHOT (default) when each batch of that source replaces the
+	// previous one, or UPSERT for streaming sources.
+	FromSource int    `yaml:"FromSource,omitempty" json:"FromSource,omitempty"`
+	On         string `yaml:"On,omitempty" json:"On,omitempty"`
+	LookupMode string `yaml:"LookupMode,omitempty" json:"LookupMode,omitempty"`
+
+	// DEFAULT sets Values on fields that are missing or null
+	Values map[string]interface{} `yaml:"Values,omitempty" json:"Values,omitempty"`
+
+	// AGGREGATE replaces the records with the aggregates of their windows
+	Aggregate *AggregateConfig `yaml:"Aggregate,omitempty" json:"Aggregate,omitempty"`
+}
+
+// renameField renames the field From to To
+type renameField struct {
+	From string
+	To   string
+}
+
+// renameList is written as a mapping of old names to new names but keeps the order of
+// the mapping, so that renames such as a to b then b to c give the same result every run
+type renameList []renameField
+
+// UnmarshalYAML reads the mapping in the order of the document
+func (r *renameList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: Rename must be a mapping of old names to new names", value.Line)
+	}
+	renames := make(renameList, 0, len(value.Content)/2)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		renames = append(renames, renameField{From: value.Content[i].Value, To: value.Content[i+1].Value})
+	}
+	*r = renames
+	return nil
+}
+
+// MarshalYAML writes the renames as a mapping in their order
+func (r renameList) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, rename := range r {
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: rename.From},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: rename.To})
+	}
+	return node, nil
+}
+
+// UnmarshalJSON reads the object in the order of the document
+func (r *renameList) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("Rename must be an object of old names to new names")
+	}
+	renames := renameList{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var to string
+		if err := decoder.Decode(&to); err != nil {
+			return err
+		}
+		renames = append(renames, renameField{From: token.(string), To: to})
+	}
+	*r = renames
+	return nil
+}
+
+// MarshalJSON writes the renames as an object in their order
+func (r renameList) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, rename := range r {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		from, _ := json.Marshal(rename.From)
+		to, _ := json.Marshal(rename.To)
+		buffer.Write(from)
+		buffer.WriteByte(':')
+		buffer.Write(to)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// runSteps executes the steps in order, each one working on the output of the previous.
+// An AGGREGATE step hands the rest of the steps and the output format over to its
+// windows when it runs in a scope.
+func runSteps(scope *pipelineScope, records []map[string]interface{}, steps []TransformationStep, outputFormat []outputRuleStructure, result *transformResult) []map[string]interface{} {
+	for index, step := range steps {
+		if len(records) == 0 {
+			break
+		}
+		if strings.ToUpper(step.Type) == stepAggregate {
+			records = aggregateRecords(scope, index, records, step, steps[index+1:], outputFormat, result)
+			continue
+		}
+		records = runStep(records, step, result)
+	}
+	return records
+}
+
+// runStep executes a single step on a batch of records
+func runStep(records []map[string]interface{}, step TransformationStep, result *transformResult) []map[string]interface{} {
+	switch strings.ToUpper(step.Type) {
+	case stepFilter:
+		return filterRecords(records, finalOutputDataJSON{
+			RuleType:   step.RuleType,
+			FilterType: step.FilterType,
+			Filter:     step.Filter,
+		}, result)
+	case stepMap:
+		return mapRecords(records, step.OutputFormat, result)
+	case stepExplode:
+		return explodeRecords(records, step, result)
+	case stepDeduplicate:
+		return deduplicateRecords(records, step, result)
+	}
+
+	output := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		// Steps change a copy so the input records stay untouched
+		record = copyRecord(record)
+
+		switch strings.ToUpper(step.Type) {
+		case stepRename:
+			for _, rename := range step.Rename {
+				if value, exists := record[rename.From]; exists {
+					delete(record, rename.From)
+					record[rename.To] = value
+				}
+			}
+		case stepDrop:
+			for _, field := range step.Fields {
+				delete(record, field)
+			}
+		case stepFlatten:
+			record = flattenRecord(record, step)
+		case stepDefault:
+			for field, value := range step.Values {
+				if current, exists := record[field]; !exists || current == nil {
+					record[field] = value
+				}
+			}
+		case stepLookup:
+			if step.FromSource != 0 {
+				enrichRecord(record, step)
+			} else {
+				lookupRecord(record, step)
+			}
+		}
+		output = append(output, record)
+	}
+	return output
+}
+
+// copyRecord returns a shallow copy of a record
+func copyRecord(record map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(record))
+	for key, value := range record {
+		copied[key] = value
+	}
+	return copied
+}
+
+// flattenRecord moves the fields of nested objects to the top level, joining the names
+// with the separator ("." by default)
+func flattenRecord(record map[string]interface{}, step TransformationStep) map[string]interface{} {
+	separator := step.Separator
+	if separator == "" {
+		separator = "."
+	}
+
+	fields := step.Fields
+	if len(fields) == 0 {
+		for key, value := range record {
+			if _, ok := value.(map[string]interface{}); ok {
+				fields = append(fields, key)
+			}
+		}
+	}
+
+	for _, field := range fields {
+		object, ok := record[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delete(record, field)
+		flattenInto(record, field, object, separator)
+	}
+	return record
+}
+
+// flattenInto copies the fields of an object into the record under prefixed names
+func flattenInto(record map[string]interface{}, prefix string, object map[string]interface{}, separator string) {
+	for key, value := range object {
+		name := prefix + separator + key
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenInto(record, name, nested, separator)
+			continue
+		}
+		record[name] = value
+	}
+}
+
+// explodeRecords emits one record per element of the array found at Field. Records
+// without elements are counted as filtered.
+func explodeRecords(records []map[string]interface{}, step TransformationStep, result *transformResult) []map[string]interface{} {
+	target := step.As
+	if target == "" {
+		target = step.Field
+	}
+
+	output := make([]map[string]interface{}, 0, len(records))
+	origins := make([]int, 0, len(records))
+	for index, record := range records {
+		value, _ := ruleValue(record, step.Field)
+		items, ok := toArray(value)
+		if !ok || len(items) == 0 {
+			result.Filtered = append(result.Filtered, record)
+			continue
+		}
+		for _, item := range items {
+			exploded := copyRecord(record)
+			exploded[target] = item
+			output = append(output, exploded)
+			origins = append(origins, result.origin(index))
+		}
+	}
+	result.origins = origins
+	return output
+}
+
+// deduplicateRecords keeps the first record of each key built from Fields, or from the
+// whole record when no field is configured
+func deduplicateRecords(records []map[string]interface{}, step TransformationStep, result *transformResult) []map[string]interface{} {
+	seen := make(map[string]bool, len(records))
+	output := make([]map[string]interface{}, 0, len(records))
+	origins := make([]int, 0, len(records))
+	for index, record := range records {
+		key := recordKey(record, step.Fields)
+		if seen[key] {
+			result.Filtered = append(result.Filtered, record)
+			continue
+		}
+		seen[key] = true
+		output = append(output, record)
+		origins = append(origins, result.origin(index))
+	}
+	result.origins = origins
+	return output
+}
+
+// recordKey returns a stable text key made of the given fields, or of the whole record
+func recordKey(record map[string]interface{}, fields []string) string {
+	if len(fields) == 0 {
+		// encoding/json sorts map keys, so equal records give equal keys
+		data, _ := json.Marshal(record)
+		return string(data)
+	}
+
+	values := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		value, _ := ruleValue(record, field)
+		values = append(values, value)
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// lookupRecord replaces the value of Field with its entry in Table. Object entries are
+// merged into the record when no Target is set.
+func lookupRecord(record map[string]interface{}, step TransformationStep) {
+	value, exists := ruleValue(record, step.Field)
+	if !exists || value == nil {
+		return
+	}
+	entry, found := step.Table[toString(value)]
+	if !found {
+		return
+	}
+
+	switch {
+	case step.Target != "":
+		record[step.Target] = entry
+	default:
+		if object, ok := entry.(map[string]interface{}); ok {
+			for key, item := range object {
+				record[key] = item
+			}
+			return
+		}
+		record[step.Field] = entry
+	}
+}
+
+// validateSteps checks that every step has the fields its type needs
+func validateSteps(errs *ValidationErrors, field string, steps []TransformationStep) {
+	for i, step := range steps {
+		stepField := fmt.Sprintf("%s[%d]", field, i)
+
+		switch strings.ToUpper(step.Type) {
+		case stepFilter:
+			if step.RuleType == "" && step.Filter == nil {
+				errs.add(stepField, "RuleType or Filter is required for FILTER")
+			}
+			validateTransformation(errs, stepField, finalOutputDataJSON{
+				RuleType:   step.RuleType,
+				FilterType: step.FilterType,
+				Filter:     step.Filter,
+			})
+		case stepMap:
+			if len(step.OutputFormat) == 0 {
+				errs.add(stepField+".OutputFormat", "is required for MAP")
+			}
+			validateOutputFormat(errs, stepField+".OutputFormat", step.OutputFormat)
+		case stepRename:
+			if len(step.Rename) == 0 {
+				errs.add(stepField+".Rename", "is required for RENAME")
+			}
+		case stepDrop:
+			if len(step.Fields) == 0 {
+				errs.add(stepField+".Fields", "is required for DROP")
+			}
+		case stepFlatten, stepDeduplicate:
+		case stepExplode:
+			requireField(errs, stepField+".Field", step.Field)
+		case stepDefault:
+			if len(step.Values) == 0 {
+				errs.add(stepField+".Values", "is required for DEFAULT")
+			}
+		case stepLookup:
+			validateLookup(errs, stepField, step)
+		case stepAggregate:
+			validateAggregate(errs, stepField+".Aggregate", step.Aggregate)
+		default:
+			types := []string{stepFilter, stepMap, stepRename, stepDrop, stepFlatten, stepExplode, stepDeduplicate, stepDefault, stepLookup, stepAggregate}
+			sort.Strings(types)
+			errs.add(stepField+".Type", "must be one of %s", strings.Join(types, ", "))
+		}
+	}
+}
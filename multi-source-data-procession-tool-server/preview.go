@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"gofr.dev/pkg/gofr"
+)
+
+// previewRequest is the body of POST /preview
+type previewRequest struct {
+	// Format of the payload, JSON (default) or CSV
+	Format string `json:"Format"`
+	// Payload is the sample data, a JSON value or a string holding JSON or CSV text
+	Payload              json.RawMessage     `json:"Payload"`
+	TransformationConfig finalOutputDataJSON `json:"TransformationConfig"`
+}
+
+// previewTransformation runs a transformation on a sample payload and returns the
+// transformed, filtered and failed records without sending anything to a destination
+func previewTransformation(c *gofr.Context) (interface{}, error) {
+	defer panicRecoveryMiddleware()
+
+	var request previewRequest
+	if err := c.Bind(&request); err != nil {
+		log.Println("Error binding data:", err)
+		return nil, err
+	}
+
+	var errs ValidationErrors
+	validateTransformation(&errs, "TransformationConfig", request.TransformationConfig)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	payload, err := previewPayload(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []map[string]interface{}
+	if strings.EqualFold(request.Format, "CSV") {
+		records, err = decodeCSVRecords(payload)
+	} else {
+		records, _, err = decodeRecords(payload)
+	}
+	if err != nil {
+		return nil, ValidationErrors{{Field: "Payload", Message: err.Error()}}
+	}
+
+	return transformRecords(records, request.TransformationConfig), nil
+}
+
+// previewPayload returns the raw sample data, unwrapping payloads sent as a JSON string
+func previewPayload(request previewRequest) ([]byte, error) {
+	if len(request.Payload) == 0 {
+		return nil, ValidationErrors{{Field: "Payload", Message: "is required"}}
+	}
+
+	var text string
+	if err := json.Unmarshal(request.Payload, &text); err == nil {
+		return []byte(text), nil
+	}
+	return request.Payload, nil
+}
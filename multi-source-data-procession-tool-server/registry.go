@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// Serialization formats of a schema registry
+const (
+	schemaFormatAvro = "AVRO"
+	schemaFormatJSON = "JSON"
+)
+
+// Content type of the schema registry REST API
+const schemaRegistryContentType = "application/vnd.schemaregistry.v1+json"
+
+// Names accepted by Avro for records and fields
+var avroNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Characters replaced when a subject is turned into an Avro name
+var avroInvalidCharacters = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// SchemaRegistryConfig serializes the records sent to a Kafka destination with a schema
+// generated from its OutputFormat and registered under Subject (the topic name followed
+// by "-value" when empty). Messages use the Confluent wire format.
+type SchemaRegistryConfig struct {
+	URL      string `yaml:"URL" json:"URL" secret:"url"`
+	Format   string `yaml:"Format,omitempty" json:"Format,omitempty"`
+	Subject  string `yaml:"Subject,omitempty" json:"Subject,omitempty"`
+	Username string `yaml:"Username,omitempty" json:"Username,omitempty"`
+	Password string `yaml:"Password,omitempty" json:"Password,omitempty" secret:"true"`
+}
+
+// SchemaIncompatibleError is returned with HTTP 409 when the schema generated from a new
+// configuration is not compatible with the latest version of its subject
+type SchemaIncompatibleError struct {
+	Subject  string
+	Messages []string
+}
+
+func (e SchemaIncompatibleError) Error() string {
+	message := fmt.Sprintf("schema of subject %s is not compatible with its latest version", e.Subject)
+	if len(e.Messages) > 0 {
+		message += ": " + strings.Join(e.Messages, "; ")
+	}
+	return message
+}
+
+// StatusCode makes GoFr respond with 409 Conflict
+func (e SchemaIncompatibleError) StatusCode() int {
+	return http.StatusConflict
+}
+
+// outputSchema is the registered schema used to serialize the records of a destination
+type outputSchema struct {
+	config       Config
+	text         string
+	id           int
+	format       string
+	recordName   string
+	codec        *goavro.Codec
+	outputFormat []outputRuleStructure
+}
+
+// Registered schemas by registry URL and subject
+var outputSchemas = make(map[string]*outputSchema)
+var outputSchemasMu sync.RWMutex
+
+// schemaFormat returns the serialization format of a registry, Avro by default
+func schemaFormat(registry SchemaRegistryConfig) string {
+	if registry.Format == "" {
+		return schemaFormatAvro
+	}
+	return strings.ToUpper(registry.Format)
+}
+
+// schemaSubject returns the subject the schema of a destination is registered under
+func schemaSubject(config Config) string {
+	if config.SchemaRegistry.Subject != "" {
+		return config.SchemaRegistry.Subject
+	}
+	return config.TopicName + "-value"
+}
+
+// outputSchemaKey identifies the schema of a destination
+func outputSchemaKey(config Config) string {
+	return strings.TrimRight(config.SchemaRegistry.URL, "/") + "|" + schemaSubject(config)
+}
+
+// prepareOutputSchemas generates the schemas of the Kafka destinations of a source,
+// including its dead letter destination, and checks them against the latest version of
+// their subject
+func prepareOutputSchemas(dataSource DataSource) (map[string]*outputSchema, error) {
+	prepared := make(map[string]*outputSchema)
+	prepare := func(config Config, outputFormat []outputRuleStructure) error {
+		if config.Type != "KAFKA" || config.SchemaRegistry == nil {
+			return nil
+		}
+		schema, err := generateOutputSchema(config, outputFormat)
+		if err != nil {
+			return err
+		}
+		if err := checkSchemaCompatibility(config, schema.text); err != nil {
+			return err
+		}
+		prepared[outputSchemaKey(config)] = schema
+		return nil
+	}
+
+	for _, config := range dataSource.Config {
+		outputFormat := dataSource.TransformationConfig.OutputFormat
+		if config.TransformationConfig != nil {
+			outputFormat = config.TransformationConfig.OutputFormat
+		}
+		if err := prepare(config, outputFormat); err != nil {
+			return nil, err
+		}
+	}
+	if dataSource.DeadLetter != nil {
+		if err := prepare(*dataSource.DeadLetter, deadLetterOutputFormat); err != nil {
+			return nil, err
+		}
+	}
+	return prepared, nil
+}
+
+// registerOutputSchemas registers prepared schemas and makes them available to the
+// Kafka producers
+func registerOutputSchemas(schemas map[string]*outputSchema) error {
+	for _, schema := range schemas {
+		id, err := registerSchema(schema.config, schema.text)
+		if err != nil {
+			return err
+		}
+		schema.id = id
+	}
+
+	outputSchemasMu.Lock()
+	defer outputSchemasMu.Unlock()
+	for key, schema := range schemas {
+		outputSchemas[key] = schema
+	}
+	return nil
+}
+
+// generateOutputSchema builds the Avro or JSON Schema of an output format
+func generateOutputSchema(config Config, outputFormat []outputRuleStructure) (*outputSchema, error) {
+	schema := &outputSchema{
+		config:       config,
+		format:       schemaFormat(*config.SchemaRegistry),
+		recordName:   avroName(schemaSubject(config)),
+		outputFormat: outputFormat,
+	}
+
+	var definition map[string]interface{}
+	if schema.format == schemaFormatAvro {
+		definition = avroRecordSchema(schema.recordName, outputFormat)
+	} else {
+		definition = jsonObjectSchema(outputFormat)
+		definition["$schema"] = "http://json-schema.org/draft-07/schema#"
+	}
+
+	text, err := json.Marshal(definition)
+	if err != nil {
+		return nil, err
+	}
+	schema.text = string(text)
+
+	if schema.format == schemaFormatAvro {
+		codec, err := goavro.NewCodec(schema.text)
+		if err != nil {
+			return nil, fmt.Errorf("cannot build Avro schema: %v", err)
+		}
+		schema.codec = codec
+	}
+	return schema, nil
+}
+
+// avroName turns a subject into a valid Avro record name
+func avroName(subject string) string {
+	name := avroInvalidCharacters.ReplaceAllString(subject, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// avroRecordSchema returns the Avro record of an output format. Every field is
+// nullable since conversion failures produce null values.
+func avroRecordSchema(name string, outputFormat []outputRuleStructure) map[string]interface{} {
+	fields := make([]interface{}, 0, len(outputFormat))
+	for _, output := range outputFormat {
+		fields = append(fields, map[string]interface{}{
+			"name":    output.DisplayName,
+			"type":    []interface{}{"null", avroType(name, output)},
+			"default": nil,
+		})
+	}
+	return map[string]interface{}{
+		"type":   "record",
+		"name":   name,
+		"fields": fields,
+	}
+}
+
+// avroType returns the Avro type of an output field
+func avroType(parent string, output outputRuleStructure) interface{} {
+	output.KeyType = serializedKeyType(output)
+	switch output.KeyType {
+	case "STRUCT":
+		return avroRecordSchema(parent+"_"+output.DisplayName, output.Structure)
+	case "ARRAY_STRUCT":
+		return map[string]interface{}{"type": "array", "items": avroRecordSchema(parent+"_"+output.DisplayName, output.Structure)}
+	}
+	if strings.HasPrefix(output.KeyType, "ARRAY_") {
+		return map[string]interface{}{"type": "array", "items": avroPrimitive(strings.TrimPrefix(output.KeyType, "ARRAY_"))}
+	}
+	return avroPrimitive(output.KeyType)
+}
+
+// serializedKeyType returns the key type of a field once masked, masks produce strings
+func serializedKeyType(output outputRuleStructure) string {
+	if output.Mask == "" {
+		return output.KeyType
+	}
+	if strings.HasPrefix(output.KeyType, "ARRAY_") {
+		return "ARRAY_STRING"
+	}
+	return "STRING"
+}
+
+// avroPrimitive maps a key type to its Avro type, dates are RFC 3339 strings
+func avroPrimitive(keyType string) string {
+	switch keyType {
+	case "INT":
+		return "long"
+	case "FLOAT":
+		return "double"
+	case "BOOL":
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// jsonObjectSchema returns the JSON Schema of an output format
+func jsonObjectSchema(outputFormat []outputRuleStructure) map[string]interface{} {
+	properties := make(map[string]interface{}, len(outputFormat))
+	for _, output := range outputFormat {
+		properties[output.DisplayName] = jsonFieldSchema(output)
+	}
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// jsonFieldSchema returns the JSON Schema of a nullable output field
+func jsonFieldSchema(output outputRuleStructure) map[string]interface{} {
+	output.KeyType = serializedKeyType(output)
+	switch output.KeyType {
+	case "STRUCT":
+		schema := jsonObjectSchema(output.Structure)
+		schema["type"] = []interface{}{"object", "null"}
+		return schema
+	case "ARRAY_STRUCT":
+		return map[string]interface{}{"type": []interface{}{"array", "null"}, "items": jsonObjectSchema(output.Structure)}
+	}
+	if strings.HasPrefix(output.KeyType, "ARRAY_") {
+		items := jsonPrimitive(strings.TrimPrefix(output.KeyType, "ARRAY_"))
+		return map[string]interface{}{"type": []interface{}{"array", "null"}, "items": items}
+	}
+	schema := jsonPrimitive(output.KeyType)
+	schema["type"] = []interface{}{schema["type"], "null"}
+	return schema
+}
+
+// jsonPrimitive returns the JSON Schema of a scalar key type
+func jsonPrimitive(keyType string) map[string]interface{} {
+	switch keyType {
+	case "INT":
+		return map[string]interface{}{"type": "integer"}
+	case "FLOAT":
+		return map[string]interface{}{"type": "number"}
+	case "BOOL":
+		return map[string]interface{}{"type": "boolean"}
+	case "DATE":
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// registryRequest calls the schema registry of a destination with a schema
+func registryRequest(config Config, path string, schemaText string) (int, []byte, error) {
+	body := map[string]interface{}{"schema": schemaText}
+	if schemaFormat(*config.SchemaRegistry) == schemaFormatJSON {
+		body["schemaType"] = "JSON"
+	}
+
+	request := client.R().
+		SetHeader("Content-Type", schemaRegistryContentType).
+		SetBody(body)
+	if config.SchemaRegistry.Username != "" {
+		request.SetBasicAuth(config.SchemaRegistry.Username, config.SchemaRegistry.Password)
+	}
+
+	resp, err := request.Post(strings.TrimRight(config.SchemaRegistry.URL, "/") + path)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode(), resp.Body(), nil
+}
+
+// checkSchemaCompatibility checks a schema against the latest version of its subject.
+// Subjects without any version accept every schema.
+func checkSchemaCompatibility(config Config, schemaText string) error {
+	subject := schemaSubject(config)
+	status, body, err := registryRequest(config, "/compatibility/subjects/"+url.PathEscape(subject)+"/versions/latest?verbose=true", schemaText)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("schema registry returned %d: %s", status, body)
+	}
+
+	var result struct {
+		IsCompatible bool     `json:"is_compatible"`
+		Messages     []string `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	if !result.IsCompatible {
+		return SchemaIncompatibleError{Subject: subject, Messages: result.Messages}
+	}
+	return nil
+}
+
+// registerSchema registers a schema under its subject and returns its id. The registry
+// returns the existing id when the schema is already registered.
+func registerSchema(config Config, schemaText string) (int, error) {
+	status, body, err := registryRequest(config, "/subjects/"+url.PathEscape(schemaSubject(config))+"/versions", schemaText)
+	if err != nil {
+		return 0, err
+	}
+	if status != http.StatusOK {
+		return 0, fmt.Errorf("schema registry returned %d: %s", status, body)
+	}
+
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, err
+	}
+	return result.ID, nil
+}
+
+// publishRegisteredKafka sends each record as a separate message in the Confluent wire
+// format: a zero byte, the schema id as 4 big endian bytes and the serialized record
+func publishRegisteredKafka(config Config, key string, data []byte) error {
+	outputSchemasMu.RLock()
+	schema, ok := outputSchemas[outputSchemaKey(config)]
+	outputSchemasMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("schema not registered for subject %s", schemaSubject(config))
+	}
+
+	records, _, err := decodeRecords(data)
+	if err != nil {
+		return fmt.Errorf("cannot decode output records: %v", err)
+	}
+	messages := make([][]byte, 0, len(records))
+	for index, record := range records {
+		message, err := schema.encode(record)
+		if err != nil {
+			return fmt.Errorf("cannot serialize record %d: %v", index, err)
+		}
+		messages = append(messages, message)
+	}
+	return sendKafkaMessages(config.IP, config.Port, config.TopicName, key, messages)
+}
+
+// encode serializes a record in the Confluent wire format
+func (s *outputSchema) encode(record map[string]interface{}) ([]byte, error) {
+	message := make([]byte, 5, 64)
+	binary.BigEndian.PutUint32(message[1:], uint32(s.id))
+
+	if s.format != schemaFormatAvro {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		return append(message, data...), nil
+	}
+
+	native, err := avroRecord(s.recordName, s.outputFormat, record)
+	if err != nil {
+		return nil, err
+	}
+	return s.codec.BinaryFromNative(message, native)
+}
+
+// avroRecord converts a record to the native form goavro expects, wrapping non null
+// values in their union branch
+func avroRecord(name string, outputFormat []outputRuleStructure, record map[string]interface{}) (map[string]interface{}, error) {
+	native := make(map[string]interface{}, len(outputFormat))
+	for _, output := range outputFormat {
+		value := record[output.DisplayName]
+		if value == nil {
+			native[output.DisplayName] = nil
+			continue
+		}
+		converted, err := avroValue(name, output, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", output.DisplayName, err)
+		}
+		native[output.DisplayName] = goavro.Union(avroBranch(name, output), converted)
+	}
+	return native, nil
+}
+
+// avroBranch returns the name of the non null branch of a field union
+func avroBranch(parent string, output outputRuleStructure) string {
+	output.KeyType = serializedKeyType(output)
+	switch {
+	case output.KeyType == "STRUCT":
+		return parent + "_" + output.DisplayName
+	case strings.HasPrefix(output.KeyType, "ARRAY_"):
+		return "array"
+	default:
+		return avroPrimitive(output.KeyType)
+	}
+}
+
+// avroValue converts a value to the Avro type of its output field
+func avroValue(parent string, output outputRuleStructure, value interface{}) (interface{}, error) {
+	output.KeyType = serializedKeyType(output)
+	switch output.KeyType {
+	case "STRUCT":
+		object, ok := toObject(value)
+		if !ok {
+			return nil, fmt.Errorf("%T is not an object", value)
+		}
+		return avroRecord(parent+"_"+output.DisplayName, output.Structure, object)
+	case "ARRAY_STRUCT":
+		items, ok := toArray(value)
+		if !ok {
+			return nil, fmt.Errorf("%T is not an array", value)
+		}
+		elements := make([]interface{}, 0, len(items))
+		for index, item := range items {
+			object, ok := toObject(item)
+			if !ok {
+				return nil, fmt.Errorf("element %d is not an object", index)
+			}
+			element, err := avroRecord(parent+"_"+output.DisplayName, output.Structure, object)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+		return elements, nil
+	}
+
+	if strings.HasPrefix(output.KeyType, "ARRAY_") {
+		elementType := strings.TrimPrefix(output.KeyType, "ARRAY_")
+		items := toSlice(value)
+		elements := make([]interface{}, 0, len(items))
+		for index, item := range items {
+			element, err := avroPrimitiveValue(elementType, item)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", index, err)
+			}
+			elements = append(elements, element)
+		}
+		return elements, nil
+	}
+	return avroPrimitiveValue(output.KeyType, value)
+}
+
+// avroPrimitiveValue converts a scalar value to its Avro type
+func avroPrimitiveValue(keyType string, value interface{}) (interface{}, error) {
+	switch keyType {
+	case "INT":
+		return toInt(value)
+	case "FLOAT":
+		return toFloat(value)
+	case "BOOL":
+		return toBool(value)
+	default:
+		if value == nil {
+			return nil, fmt.Errorf("null element")
+		}
+		return toString(value), nil
+	}
+}
+
+// validateSchemaRegistry checks the registry of a Kafka destination and that its output
+// format can be turned into a schema
+func validateSchemaRegistry(errs *ValidationErrors, field string, config Config, outputFormat []outputRuleStructure) {
+	if config.Type != "KAFKA" {
+		errs.add(field, "is only supported for KAFKA destinations")
+	}
+	validateURL(errs, field+".URL", config.SchemaRegistry.URL)
+
+	format := schemaFormat(*config.SchemaRegistry)
+	if format != schemaFormatAvro && format != schemaFormatJSON {
+		errs.add(field+".Format", "must be %s or %s", schemaFormatAvro, schemaFormatJSON)
+	}
+	if len(outputFormat) == 0 {
+		errs.add(field, "an OutputFormat is required to generate the schema")
+	}
+	if format == schemaFormatAvro {
+		validateAvroNames(errs, field, outputFormat)
+	}
+}
+
+// validateAvroNames checks that the display names of an output format are Avro names
+func validateAvroNames(errs *ValidationErrors, field string, outputFormat []outputRuleStructure) {
+	for _, output := range outputFormat {
+		if !avroNamePattern.MatchString(output.DisplayName) {
+			errs.add(field, "display name %q is not a valid Avro field name", output.DisplayName)
+		}
+		validateAvroNames(errs, field, output.Structure)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// registryStub answers the compatibility and registration calls of a schema registry
+type registryStub struct {
+	compatibilityStatus int
+	compatibilityBody   string
+	registered          []string
+}
+
+func (s *registryStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	data, _ := io.ReadAll(r.Body)
+	json.Unmarshal(data, &body)
+
+	switch r.URL.Path {
+	case "/compatibility/subjects/orders-value/versions/latest":
+		w.WriteHeader(s.compatibilityStatus)
+		io.WriteString(w, s.compatibilityBody)
+	case "/subjects/orders-value/versions":
+		s.registered = append(s.registered, body.Schema)
+		io.WriteString(w, `{"id": 42}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func registryTestSource(url string, format string) DataSource {
+	return DataSource{
+		Source: 1,
+		Config: []Config{{
+			Type:           "KAFKA",
+			TopicName:      "orders",
+			SchemaRegistry: &SchemaRegistryConfig{URL: url, Format: format},
+		}},
+		TransformationConfig: finalOutputDataJSON{
+			OutputFormat: []outputRuleStructure{
+				{DisplayName: "id", KeyType: "INT"},
+				{DisplayName: "name", KeyType: "STRING"},
+			},
+		},
+	}
+}
+
+func TestRegisterOutputSchemas(t *testing.T) {
+	client = resty.New()
+	stub := &registryStub{compatibilityStatus: http.StatusNotFound}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dataSource := registryTestSource(server.URL, "")
+	schemas, err := prepareOutputSchemas(dataSource)
+	if err != nil {
+		t.Fatalf("prepareOutputSchemas: %v", err)
+	}
+	if err := registerOutputSchemas(schemas); err != nil {
+		t.Fatalf("registerOutputSchemas: %v", err)
+	}
+
+	if len(stub.registered) != 1 {
+		t.Fatalf("registered %d schemas, want 1", len(stub.registered))
+	}
+	outputSchemasMu.RLock()
+	schema, ok := outputSchemas[outputSchemaKey(dataSource.Config[0])]
+	outputSchemasMu.RUnlock()
+	if !ok {
+		t.Fatal("schema not available to the producers")
+	}
+	if schema.id != 42 {
+		t.Errorf("schema id = %d, want 42", schema.id)
+	}
+	if schema.text != stub.registered[0] {
+		t.Errorf("registered schema %s, want %s", stub.registered[0], schema.text)
+	}
+}
+
+func TestPrepareDeadLetterSchema(t *testing.T) {
+	client = resty.New()
+	stub := &registryStub{compatibilityStatus: http.StatusNotFound}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dataSource := registryTestSource(server.URL, "")
+	dataSource.Config = nil
+	dataSource.DeadLetter = &Config{
+		Type:           "KAFKA",
+		TopicName:      "orders",
+		SchemaRegistry: &SchemaRegistryConfig{URL: server.URL},
+	}
+	schemas, err := prepareOutputSchemas(dataSource)
+	if err != nil {
+		t.Fatalf("prepareOutputSchemas: %v", err)
+	}
+	schema, ok := schemas[outputSchemaKey(*dataSource.DeadLetter)]
+	if !ok {
+		t.Fatal("dead letter schema not prepared")
+	}
+	if len(schema.outputFormat) != len(deadLetterOutputFormat) {
+		t.Errorf("dead letter schema has %d fields, want %d", len(schema.outputFormat), len(deadLetterOutputFormat))
+	}
+}
+
+func TestCheckSchemaCompatibility(t *testing.T) {
+	tests := []struct {
+		name             string
+		status           int
+		body             string
+		wantErr          bool
+		wantIncompatible bool
+	}{
+		{name: "new subject", status: http.StatusNotFound},
+		{name: "compatible", status: http.StatusOK, body: `{"is_compatible": true}`},
+		{name: "incompatible", status: http.StatusOK, body: `{"is_compatible": false, "messages": ["field id changed type"]}`, wantErr: true, wantIncompatible: true},
+		{name: "registry error", status: http.StatusInternalServerError, body: `{"message": "down"}`, wantErr: true},
+	}
+
+	client = resty.New()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(&registryStub{compatibilityStatus: test.status, compatibilityBody: test.body})
+			defer server.Close()
+
+			_, err := prepareOutputSchemas(registryTestSource(server.URL, ""))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			var incompatible SchemaIncompatibleError
+			if errors.As(err, &incompatible) != test.wantIncompatible {
+				t.Fatalf("error = %v, want incompatible %v", err, test.wantIncompatible)
+			}
+			if test.wantIncompatible && incompatible.StatusCode() != http.StatusConflict {
+				t.Errorf("status code = %d, want %d", incompatible.StatusCode(), http.StatusConflict)
+			}
+		})
+	}
+}
+
+func TestEncodeWireFormat(t *testing.T) {
+	record := map[string]interface{}{"id": 7.0, "name": "Ada"}
+
+	for _, format := range []string{schemaFormatAvro, schemaFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			dataSource := registryTestSource("http://registry", format)
+			schema, err := generateOutputSchema(dataSource.Config[0], dataSource.TransformationConfig.OutputFormat)
+			if err != nil {
+				t.Fatalf("generateOutputSchema: %v", err)
+			}
+			schema.id = 258
+
+			message, err := schema.encode(record)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if message[0] != 0 {
+				t.Errorf("magic byte = %d, want 0", message[0])
+			}
+			if id := binary.BigEndian.Uint32(message[1:5]); id != 258 {
+				t.Errorf("schema id = %d, want 258", id)
+			}
+
+			var decoded map[string]interface{}
+			if format == schemaFormatAvro {
+				native, _, err := schema.codec.NativeFromBinary(message[5:])
+				if err != nil {
+					t.Fatalf("NativeFromBinary: %v", err)
+				}
+				decoded = native.(map[string]interface{})
+				if id := decoded["id"].(map[string]interface{})["long"]; id != int64(7) {
+					t.Errorf("id = %v, want 7", id)
+				}
+				if name := decoded["name"].(map[string]interface{})["string"]; name != "Ada" {
+					t.Errorf("name = %v, want Ada", name)
+				}
+				return
+			}
+			if err := json.Unmarshal(message[5:], &decoded); err != nil {
+				t.Fatalf("payload is not JSON: %v", err)
+			}
+			if decoded["id"] != 7.0 || decoded["name"] != "Ada" {
+				t.Errorf("payload = %v, want %v", decoded, record)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// routeRecords splits the records of a source between its destinations and returns the
+// indexes of the records each destination receives. A destination with a Route receives
+// the records matching it, a DefaultRoute destination receives the records no Route
+// matched, and any other destination receives every record. Records for which a Route
+// cannot be evaluated go to no destination and are returned in failed instead.
+func routeRecords(config DataSource, records []map[string]interface{}) (routed [][]int, failed map[int]error) {
+	routed = make([][]int, len(config.Config))
+	failed = make(map[int]error)
+
+	hasRoutes := false
+	for _, cfg := range config.Config {
+		if cfg.Route != "" || cfg.DefaultRoute {
+			hasRoutes = true
+			break
+		}
+	}
+	if !hasRoutes {
+		all := make([]int, len(records))
+		for position := range records {
+			all[position] = position
+		}
+		for index := range config.Config {
+			routed[index] = all
+		}
+		return routed, failed
+	}
+
+	for position, record := range records {
+		matches := make([]bool, len(config.Config))
+		matched := false
+		var routeErr error
+		for index, cfg := range config.Config {
+			if cfg.Route == "" {
+				continue
+			}
+			matches[index], routeErr = routeMatches(cfg.Route, record)
+			if routeErr != nil {
+				routeErr = fmt.Errorf("route of destination %d: %v", index, routeErr)
+				break
+			}
+			matched = matched || matches[index]
+		}
+		if routeErr != nil {
+			failed[position] = routeErr
+			continue
+		}
+
+		for index, cfg := range config.Config {
+			switch {
+			case matches[index]:
+				routed[index] = append(routed[index], position)
+			case cfg.DefaultRoute && !matched:
+				routed[index] = append(routed[index], position)
+			case cfg.Route == "" && !cfg.DefaultRoute:
+				routed[index] = append(routed[index], position)
+			}
+		}
+	}
+	return routed, failed
+}
+
+// routeMatches evaluates a route expression against a record
+func routeMatches(route string, record map[string]interface{}) (bool, error) {
+	value, err := evaluateExpression(route, record)
+	if err != nil {
+		return false, err
+	}
+	matched, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("route returned %v instead of a boolean", value)
+	}
+	return matched, nil
+}
+
+// routeProbe is a record in which every field is 0, used to find the type of the value
+// a route returns without knowing the records of the source
+type routeProbe struct{}
+
+// SelectGVal returns 0 for any field
+func (routeProbe) SelectGVal(ctx context.Context, key string) (interface{}, error) {
+	return 0.0, nil
+}
+
+// validateRoute checks that a route parses and returns a boolean. Routes that cannot be
+// evaluated on the probe record, e.g. because they index into a field, are accepted.
+func validateRoute(route string) error {
+	evaluable, err := compileExpression(route)
+	if err != nil {
+		return fmt.Errorf("cannot parse route: %v", err)
+	}
+	value, err := evaluable(context.Background(), routeProbe{})
+	if err != nil {
+		return nil
+	}
+	if _, ok := value.(bool); !ok {
+		return fmt.Errorf("route must be a boolean expression, it returned %T", value)
+	}
+	return nil
+}
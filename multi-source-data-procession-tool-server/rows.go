@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanRows reads every row of a result into a record. Columns keep the type of their
+// database column: integers, floats, decimals, booleans, times as RFC 3339 strings,
+// JSON documents as objects and NULL as null.
+func scanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]map[string]interface{}, 0)
+	values := make([]interface{}, len(columnTypes))
+	scanArgs := make([]interface{}, len(columnTypes))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, err
+		}
+		record := make(map[string]interface{}, len(columnTypes))
+		for i, columnType := range columnTypes {
+			record[columnType.Name()] = columnValue(values[i], columnType.DatabaseTypeName())
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// columnValue converts a scanned value to the JSON type of its database type. Drivers
+// return some types, such as MySQL numbers or PostgreSQL decimals, as raw bytes.
+func columnValue(value interface{}, databaseType string) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return rawColumnValue(string(v), databaseType)
+	case string:
+		return rawColumnValue(v, databaseType)
+	default:
+		return v
+	}
+}
+
+// Decimal texts that are valid JSON numbers
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// rawColumnValue parses the text of a column according to its database type, keeping
+// the text when it cannot be parsed
+func rawColumnValue(text string, databaseType string) interface{} {
+	switch strings.ToUpper(databaseType) {
+	case "INT", "INTEGER", "TINYINT", "SMALLINT", "MEDIUMINT", "BIGINT", "YEAR",
+		"UNSIGNED INT", "UNSIGNED TINYINT", "UNSIGNED SMALLINT", "UNSIGNED MEDIUMINT", "UNSIGNED BIGINT",
+		"INT2", "INT4", "INT8", "SERIAL", "BIGSERIAL":
+		if number, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return number
+		}
+		if number, err := strconv.ParseUint(text, 10, 64); err == nil {
+			return number
+		}
+	case "DECIMAL", "NUMERIC":
+		// Exact numbers keep every digit, float64 would round them
+		if jsonNumberPattern.MatchString(text) {
+			return json.Number(text)
+		}
+	case "FLOAT", "DOUBLE", "REAL", "FLOAT4", "FLOAT8":
+		if number, err := strconv.ParseFloat(text, 64); err == nil {
+			return number
+		}
+	case "BOOL", "BOOLEAN", "BIT":
+		if flag, err := strconv.ParseBool(text); err == nil {
+			return flag
+		}
+		if text == "\x01" || text == "\x00" {
+			return text == "\x01"
+		}
+	case "JSON", "JSONB":
+		if document, err := decodeJSON([]byte(text)); err == nil {
+			return document
+		}
+	case "DATE", "DATETIME", "TIMESTAMP", "TIMESTAMPTZ":
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02 15:04:05.999999999-07", "2006-01-02"} {
+			if parsed, err := time.Parse(layout, text); err == nil {
+				return parsed.Format(time.RFC3339Nano)
+			}
+		}
+	}
+	return text
+}
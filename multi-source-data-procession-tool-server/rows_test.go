@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRawColumnValue(t *testing.T) {
+	tests := []struct {
+		text         string
+		databaseType string
+		want         interface{}
+	}{
+		{text: "42", databaseType: "int", want: int64(42)},
+		{text: "-7", databaseType: "INT8", want: int64(-7)},
+		{text: "18446744073709551615", databaseType: "UNSIGNED BIGINT", want: uint64(18446744073709551615)},
+		{text: "12345678901234567890.123", databaseType: "DECIMAL", want: json.Number("12345678901234567890.123")},
+		{text: "NaN", databaseType: "NUMERIC", want: "NaN"},
+		{text: "1.5", databaseType: "float8", want: 1.5},
+		{text: "t", databaseType: "bool", want: true},
+		{text: "\x01", databaseType: "BIT", want: true},
+		{text: "\x00", databaseType: "BIT", want: false},
+		{text: `{"a": [1, 2.5]}`, databaseType: "jsonb", want: map[string]interface{}{"a": []interface{}{int64(1), 2.5}}},
+		{text: "{broken", databaseType: "JSON", want: "{broken"},
+		{text: "2024-03-01 10:20:30", databaseType: "DATETIME", want: "2024-03-01T10:20:30Z"},
+		{text: "2024-03-01 10:20:30.5+02", databaseType: "timestamptz", want: "2024-03-01T10:20:30.5+02:00"},
+		{text: "2024-03-01", databaseType: "DATE", want: "2024-03-01T00:00:00Z"},
+		{text: "abc", databaseType: "INT", want: "abc"},
+		{text: "hello", databaseType: "VARCHAR", want: "hello"},
+	}
+
+	for _, test := range tests {
+		if got := rawColumnValue(test.text, test.databaseType); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("rawColumnValue(%q, %q) = %#v, want %#v", test.text, test.databaseType, got, test.want)
+		}
+	}
+}
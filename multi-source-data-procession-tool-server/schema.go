@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// sourceSchema returns the JSON Schema of a source, nil when it has none
+func sourceSchema(dataSource DataSource) (*jsonschema.Schema, error) {
+	var text []byte
+	switch {
+	case dataSource.SchemaFile != "":
+		data, err := ioutil.ReadFile(dataSource.SchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		text = data
+	case len(dataSource.Schema) > 0:
+		data, err := json.Marshal(dataSource.Schema)
+		if err != nil {
+			return nil, err
+		}
+		text = data
+	default:
+		return nil, nil
+	}
+	return compileSchema(string(text))
+}
+
+// compileSchema compiles the text of a JSON Schema
+func compileSchema(text string) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("schema.json", strings.NewReader(text)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("schema.json")
+}
+
+// validateRecords keeps the records matching the JSON Schema of their source, compiled
+// when the source was deployed. The other records are sent to the dead letter
+// destination with the reasons they failed and counted.
+func validateRecords(sourceID int, dataSource DataSource, records []map[string]interface{}) []map[string]interface{} {
+	schema := dataSource.schema
+	if schema == nil {
+		return records
+	}
+
+	valid := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		if err := schema.Validate(schemaInstance(record)); err != nil {
+			rejectRecord(sourceID, record, schemaFailure(err))
+			continue
+		}
+		valid = append(valid, record)
+	}
+	return valid
+}
+
+// schemaInstance converts a record to the plain JSON values expected by the validator
+func schemaInstance(record map[string]interface{}) interface{} {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return record
+	}
+	// The validator compares json.Number values without rounding them
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var instance interface{}
+	if err := decoder.Decode(&instance); err != nil {
+		return record
+	}
+	return instance
+}
+
+// schemaFailure lists every location of a record that failed its schema
+func schemaFailure(err error) string {
+	validationErr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err.Error()
+	}
+
+	var reasons []string
+	for _, unit := range validationErr.BasicOutput().Errors {
+		if unit.Error == "" || strings.HasPrefix(unit.Error, "doesn't validate with") {
+			continue
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		reasons = append(reasons, location+": "+unit.Error)
+	}
+	if len(reasons) == 0 {
+		return validationErr.Error()
+	}
+	return "schema validation failed: " + strings.Join(reasons, "; ")
+}
+
+// rejectRecord sends a record that failed its schema to the dead letter destination
+func rejectRecord(sourceID int, record map[string]interface{}, reason string) {
+	incrementCounter(metricSchemaRejected, "source", strconv.Itoa(sourceID))
+	sendToDeadLetter(sourceID, record, reason)
+}
+
+// validateSchema checks that the JSON Schema of a source compiles
+func validateSchema(errs *ValidationErrors, field string, dataSource DataSource) {
+	if dataSource.SchemaFile != "" && len(dataSource.Schema) > 0 {
+		errs.add(field+".SchemaFile", "cannot be used together with Schema")
+		return
+	}
+	if _, err := sourceSchema(dataSource); err != nil {
+		errs.add(field+".Schema", "invalid JSON Schema: %v", err)
+	}
+}
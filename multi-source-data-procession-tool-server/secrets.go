@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Value returned instead of a plaintext secret
+const redactedSecret = "******"
+
+// Prefix of the values read from a file, such as "file:/run/secrets/db_password"
+const secretFilePrefix = "file:"
+
+// Directory the files of "file:" references must be in, unless SECRETS_DIR is set
+const defaultSecretsDir = "/run/secrets"
+
+// References to environment variables, such as "${env:DB_PASS}"
+var secretEnvPattern = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// isSecretReference reports whether a value refers to a secret instead of holding it
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, secretFilePrefix) || secretEnvPattern.MatchString(value)
+}
+
+// secretsDir returns the directory "file:" references are read from
+func secretsDir() string {
+	if dir := os.Getenv("SECRETS_DIR"); dir != "" {
+		return dir
+	}
+	return defaultSecretsDir
+}
+
+// secretEnvAllowed reports whether configurations may refer to an environment variable.
+// Only the variables listed in SECRET_ENV_ALLOWLIST, separated by commas, are allowed.
+func secretEnvAllowed(name string) bool {
+	for _, allowed := range strings.Split(os.Getenv("SECRET_ENV_ALLOWLIST"), ",") {
+		if strings.TrimSpace(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecret returns the content of the file a value refers to, or the value with
+// its environment references replaced. Missing variables and files are errors.
+func resolveSecret(value string) (string, error) {
+	return resolveSecretReference(value, func(string) bool { return true })
+}
+
+// resolveConfigSecret resolves a reference of a source or destination configuration,
+// which may only use the environment variables of the allowlist
+func resolveConfigSecret(value string) (string, error) {
+	return resolveSecretReference(value, secretEnvAllowed)
+}
+
+// resolveSecretReference resolves a value whose files must be in the secrets directory
+// and whose environment variables must be allowed by envAllowed
+func resolveSecretReference(value string, envAllowed func(string) bool) (string, error) {
+	if strings.HasPrefix(value, secretFilePrefix) {
+		path, err := secretFilePath(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var missing, denied []string
+	resolved := secretEnvPattern.ReplaceAllStringFunc(value, func(reference string) string {
+		name := secretEnvPattern.FindStringSubmatch(reference)[1]
+		if !envAllowed(name) {
+			denied = append(denied, name)
+			return ""
+		}
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return secret
+	})
+	if len(denied) > 0 {
+		return "", fmt.Errorf("environment variable %s is not in SECRET_ENV_ALLOWLIST", strings.Join(denied, ", "))
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
+
+// checkSecretReference returns the reason deploy would refuse the references of a
+// value: an environment variable missing from SECRET_ENV_ALLOWLIST or a file outside the
+// secrets directory. Whether the variable or the file exists is only checked at deploy.
+func checkSecretReference(value string) error {
+	if strings.HasPrefix(value, secretFilePrefix) {
+		_, err := secretFilePath(strings.TrimPrefix(value, secretFilePrefix))
+		return err
+	}
+	for _, match := range secretEnvPattern.FindAllStringSubmatch(value, -1) {
+		if !secretEnvAllowed(match[1]) {
+			return fmt.Errorf("refers to environment variable %s, which is not listed in SECRET_ENV_ALLOWLIST", match[1])
+		}
+	}
+	return nil
+}
+
+// secretFilePath returns the path of a "file:" reference once checked that it stays in
+// the secrets directory
+func secretFilePath(path string) (string, error) {
+	dir, err := filepath.Abs(secretsDir())
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	if relative, err := filepath.Rel(dir, path); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("secret file %s is not in %s", path, dir)
+	}
+	return path, nil
+}
+
+// resolveSecrets replaces the secret references of the fields tagged secret by their
+// values, just before a configuration is deployed
+func resolveSecrets(data *ConfigData) error {
+	var errs []string
+	walkStrings(reflect.ValueOf(data).Elem(), "", indexName, func(field reflect.StructField, path string, value reflect.Value) {
+		if field.Tag.Get("secret") == "" || !isSecretReference(value.String()) {
+			return
+		}
+		resolved, err := resolveConfigSecret(value.String())
+		if err != nil {
+			errs = append(errs, path+": "+err.Error())
+			return
+		}
+		value.SetString(resolved)
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot resolve secrets: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// redactSecrets hides the plaintext values of the fields tagged secret:"true", and the
+// credentials of the URLs tagged secret:"url". Secret references are kept since they do
+// not disclose anything.
+func redactSecrets(data *ConfigData) {
+	walkStrings(reflect.ValueOf(data).Elem(), "", indexName, func(field reflect.StructField, path string, value reflect.Value) {
+		if value.String() == "" || isSecretReference(value.String()) {
+			return
+		}
+		switch field.Tag.Get("secret") {
+		case "true":
+			value.SetString(redactedSecret)
+		case "url":
+			value.SetString(redactURL(value.String()))
+		}
+	})
+}
+
+// redactURL hides the password, or the user when there is no password, and the query
+// values of a URL. Values that are secret references are kept.
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return redactedSecret
+	}
+	// url.Userinfo escapes "*", so the redacted user information is put back afterwards
+	userinfo := ""
+	if parsed.User != nil {
+		userinfo = redactedSecret + "@"
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			userinfo = url.User(parsed.User.Username()).String() + ":" + redactedSecret + "@"
+		}
+		parsed.User = nil
+	}
+	if parsed.RawQuery != "" {
+		parameters := strings.Split(parsed.RawQuery, "&")
+		for i, parameter := range parameters {
+			name, parameterValue, found := strings.Cut(parameter, "=")
+			if !found {
+				continue
+			}
+			if decoded, err := url.QueryUnescape(parameterValue); err == nil && isSecretReference(decoded) {
+				continue
+			}
+			parameters[i] = name + "=" + redactedSecret
+		}
+		parsed.RawQuery = strings.Join(parameters, "&")
+	}
+	if userinfo != "" {
+		return parsed.Scheme + "://" + userinfo + strings.TrimPrefix(parsed.String(), parsed.Scheme+"://")
+	}
+	return parsed.String()
+}
+
+// redactConfigYAML redacts the secrets of a YAML configuration
+func redactConfigYAML(content []byte) ([]byte, error) {
+	var data ConfigData
+	if err := yaml.Unmarshal(content, &data); err != nil {
+		return nil, err
+	}
+	redactSecrets(&data)
+	return yaml.Marshal(data)
+}
+
+// restoreRedactedSecrets puts back the saved value of the secret fields a client sent
+// back redacted, so a configuration read from loadConfiguration can be saved again.
+// Data sources are matched by Source, connectors by what they connect to and output
+// fields by DisplayName, so that reordered or inserted entries keep their own secrets.
+// A redacted field without exactly one saved counterpart is an error.
+func restoreRedactedSecrets(data *ConfigData, saved ConfigData) error {
+	savedValues := make(map[string][]string)
+	walkStrings(reflect.ValueOf(&saved).Elem(), "", identityName, func(field reflect.StructField, path string, value reflect.Value) {
+		if field.Tag.Get("secret") != "" {
+			savedValues[path] = append(savedValues[path], value.String())
+		}
+	})
+
+	var errs ValidationErrors
+	walkStrings(reflect.ValueOf(data).Elem(), "", identityName, func(field reflect.StructField, path string, value reflect.Value) {
+		tag := field.Tag.Get("secret")
+		if tag == "" || !strings.Contains(value.String(), redactedSecret) {
+			return
+		}
+		candidates := savedValues[path]
+		if len(candidates) == 1 {
+			if tag == "url" && value.String() == redactURL(candidates[0]) || value.String() == redactedSecret {
+				value.SetString(candidates[0])
+				return
+			}
+		}
+		errs.add(path, "is redacted and has no unique saved value, send the secret again")
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// indexName names the elements of a slice by their position
+func indexName(element reflect.Value, index int) string {
+	return strconv.Itoa(index)
+}
+
+// identityName names data sources by Source, connectors by their connection and output
+// fields by DisplayName, other slice elements by their position
+func identityName(element reflect.Value, index int) string {
+	switch value := element.Interface().(type) {
+	case DataSource:
+		return fmt.Sprintf("Source=%d", value.Source)
+	case Config:
+		return connectorIdentity(value)
+	case outputRuleStructure:
+		return value.DisplayName
+	}
+	return strconv.Itoa(index)
+}
+
+// connectorIdentity describes what a connector connects to. The URL only contributes
+// its redacted form, which is the same on both sides of a restore.
+func connectorIdentity(config Config) string {
+	return strings.Join([]string{
+		config.Type, config.DBType, config.DBHost, strconv.Itoa(config.DBPort), config.DBUser, config.DBName,
+		config.TableName, redactURL(config.URL), config.IP, config.Port, config.TopicName, config.FilePath,
+	}, "|")
+}
+
+// walkStrings calls visit for every string field reachable from a struct, with its
+// path made of the YAML field names and of the names name gives to slice elements
+func walkStrings(value reflect.Value, path string, name func(reflect.Value, int) string, visit func(reflect.StructField, string, reflect.Value)) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			walkStrings(value.Elem(), path, name, visit)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			walkStrings(value.Index(i), fmt.Sprintf("%s[%s]", path, name(value.Index(i), i)), name, visit)
+		}
+	case reflect.Struct:
+		valueType := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			field := valueType.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			fieldName := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if fieldName == "" {
+				fieldName = field.Name
+			}
+			fieldPath := fieldName
+			if path != "" {
+				fieldPath = path + "." + fieldName
+			}
+			fieldValue := value.Field(i)
+			if fieldValue.Kind() == reflect.String {
+				visit(field, fieldPath, fieldValue)
+				continue
+			}
+			walkStrings(fieldValue, fieldPath, name, visit)
+		}
+	}
+}
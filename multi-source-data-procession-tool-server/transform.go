@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// recordError reports a record that could not be transformed. Index is the position of
+// the input record it comes from, or -1 for aggregates.
+type recordError struct {
+	Index  int                    `json:"index"`
+	Record map[string]interface{} `json:"record"`
+	Error  string                 `json:"error"`
+}
+
+// transformResult holds the outcome of transforming a batch of records. origins holds,
+// for every record of the step running, the index of the input record it comes from.
+type transformResult struct {
+	Records  []map[string]interface{} `json:"records"`
+	Filtered []map[string]interface{} `json:"filtered"`
+	Errors   []recordError            `json:"errors"`
+	origins  []int
+}
+
+// origin returns the index in the input batch of the record at index, or -1 for records
+// built from several input records such as aggregates
+func (r *transformResult) origin(index int) int {
+	if index < len(r.origins) {
+		return r.origins[index]
+	}
+	return -1
+}
+
+// reject records the error of the record at index under the index of its input record
+func (r *transformResult) reject(index int, record map[string]interface{}, err error) {
+	r.Errors = append(r.Errors, recordError{Index: r.origin(index), Record: record, Error: err.Error()})
+}
+
+// decodeRecords turns a JSON object, a JSON array of objects or a JSON array of rows
+// whose first row is the header into a list of records. single reports whether the
+// payload was a single JSON object. CSV text is only read by the file sources, through
+// decodeCSVRecords.
+func decodeRecords(payload []byte) (records []map[string]interface{}, single bool, err error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return nil, false, errors.New("empty payload")
+	}
+
+	switch trimmed[0] {
+	case '{':
+		value, err := decodeJSON(trimmed)
+		if err != nil {
+			return nil, false, err
+		}
+		return []map[string]interface{}{value.(map[string]interface{})}, true, nil
+	case '[':
+		value, err := decodeJSON(trimmed)
+		if err != nil {
+			return nil, false, err
+		}
+		records, err := recordsFromItems(value.([]interface{}))
+		return records, false, err
+	default:
+		return nil, false, errors.New("payload is not a JSON object or array")
+	}
+}
+
+// decodeJSON decodes a single JSON value without losing the precision of its numbers:
+// integers become int64, other numbers float64 when it holds them exactly, and the
+// numbers neither can hold stay json.Number
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after the top-level JSON value")
+	}
+	return normalizeNumbers(value), nil
+}
+
+// normalizeNumbers replaces the json.Number values of a decoded JSON value
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		return normalizeNumber(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+	return value
+}
+
+// normalizeNumber converts a JSON number to int64, or to float64 when the float64 reads
+// back as the same number, and keeps it as it is otherwise
+func normalizeNumber(number json.Number) interface{} {
+	if integer, err := number.Int64(); err == nil {
+		return integer
+	}
+	float, err := number.Float64()
+	if err != nil {
+		return number
+	}
+	exact, ok := new(big.Rat).SetString(number.String())
+	rounded, _ := new(big.Rat).SetString(strconv.FormatFloat(float, 'g', -1, 64))
+	if !ok || rounded == nil || exact.Cmp(rounded) != 0 {
+		return number
+	}
+	return float
+}
+
+// recordsFromItems converts the elements of a JSON array into records
+func recordsFromItems(items []interface{}) ([]map[string]interface{}, error) {
+	records := make([]map[string]interface{}, 0, len(items))
+	if len(items) == 0 {
+		return records, nil
+	}
+
+	// An array of rows uses its first row as the header
+	if header, ok := items[0].([]interface{}); ok {
+		for index, item := range items[1:] {
+			row, ok := item.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("row %d is not an array", index+1)
+			}
+			record := make(map[string]interface{}, len(header))
+			for i, column := range header {
+				if i < len(row) {
+					record[fmt.Sprint(column)] = row[i]
+				}
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	for index, item := range items {
+		record, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("item %d is not an object", index)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// decodeCSVRecords reads CSV text whose first line is the header
+func decodeCSVRecords(data []byte) ([]map[string]interface{}, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CSV header: %v", err)
+	}
+
+	var records []map[string]interface{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := make(map[string]interface{}, len(header))
+		for i, column := range header {
+			if i < len(row) {
+				record[strings.TrimSpace(column)] = row[i]
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// transformRecords filters the records with RuleType and Filter, runs the Steps in order
+// and maps the remaining records to OutputFormat, without any side effect on the running
+// pipelines
+func transformRecords(records []map[string]interface{}, transformation finalOutputDataJSON) transformResult {
+	return transformRecordsIn(nil, records, transformation)
+}
+
+// transformRecordsIn runs a transformation for the destination pipeline of the scope,
+// which keeps the state of its AGGREGATE steps between batches
+func transformRecordsIn(scope *pipelineScope, records []map[string]interface{}, transformation finalOutputDataJSON) transformResult {
+	result := transformResult{
+		Records:  make([]map[string]interface{}, 0, len(records)),
+		Filtered: make([]map[string]interface{}, 0),
+		Errors:   make([]recordError, 0),
+		origins:  make([]int, len(records)),
+	}
+	for index := range records {
+		result.origins[index] = index
+	}
+
+	records = filterRecords(records, transformation, &result)
+	records = runSteps(scope, records, transformation.Steps, transformation.OutputFormat, &result)
+	result.Records = append(result.Records, mapRecords(records, transformation.OutputFormat, &result)...)
+	return result
+}
+
+// filterRecords keeps the records matching the RuleType and Filter of a transformation
+func filterRecords(records []map[string]interface{}, transformation finalOutputDataJSON, result *transformResult) []map[string]interface{} {
+	filter, err := newRecordFilter(transformation)
+	if err != nil {
+		// Without a valid filter no record can be kept
+		for index, record := range records {
+			result.reject(index, record, err)
+		}
+		result.origins = nil
+		return nil
+	}
+	if filter == nil {
+		return records
+	}
+
+	kept := make([]map[string]interface{}, 0, len(records))
+	origins := make([]int, 0, len(records))
+	for index, record := range records {
+		keep, err := filter(record)
+		if err != nil {
+			result.reject(index, record, err)
+			continue
+		}
+		if !keep {
+			result.Filtered = append(result.Filtered, record)
+			continue
+		}
+		kept = append(kept, record)
+		origins = append(origins, result.origin(index))
+	}
+	result.origins = origins
+	return kept
+}
+
+// mapRecords builds the output records of an output format, records are kept as they
+// are when there is no output format
+func mapRecords(records []map[string]interface{}, outputFormat []outputRuleStructure, result *transformResult) []map[string]interface{} {
+	if len(outputFormat) == 0 {
+		return records
+	}
+
+	mapped := make([]map[string]interface{}, 0, len(records))
+	origins := make([]int, 0, len(records))
+	for index, record := range records {
+		output, err := outputInHighLevelTransform(outputFormat, record)
+		if err != nil {
+			result.reject(index, record, err)
+			continue
+		}
+		mapped = append(mapped, output)
+		origins = append(origins, result.origin(index))
+	}
+	result.origins = origins
+	return mapped
+}
+
+// structField builds a nested object from the object found under Key, or from the
+// current record when Key is empty
+func structField(record map[string]interface{}, output outputRuleStructure) (interface{}, error) {
+	source := record
+	if output.Key != "" {
+		value := sourceValue(record, output.Key)
+		if value == nil {
+			return convertField(nil, output)
+		}
+		object, ok := toObject(value)
+		if !ok {
+			return fieldFailure(output, fmt.Errorf("%T is not an object", value))
+		}
+		source = object
+	}
+
+	nested, err := outputInHighLevelTransform(output.Structure, source)
+	if err != nil {
+		return nil, fmt.Errorf("%s.%v", output.DisplayName, err)
+	}
+	return nested, nil
+}
+
+// arrayStructField builds an array of nested objects, one per element of the array
+// found under Key. An empty Key builds a single element from the current record.
+func arrayStructField(record map[string]interface{}, output outputRuleStructure) (interface{}, error) {
+	if output.Key == "" {
+		nested, err := outputInHighLevelTransform(output.Structure, record)
+		if err != nil {
+			return nil, fmt.Errorf("%s[0].%v", output.DisplayName, err)
+		}
+		return []interface{}{nested}, nil
+	}
+
+	value := sourceValue(record, output.Key)
+	if value == nil {
+		return convertField(nil, output)
+	}
+	items, ok := toArray(value)
+	if !ok {
+		return fieldFailure(output, fmt.Errorf("%T is not an array", value))
+	}
+
+	elements := make([]interface{}, 0, len(items))
+	for index, item := range items {
+		object, ok := toObject(item)
+		if !ok {
+			return fieldFailure(output, fmt.Errorf("element %d is not an object", index))
+		}
+		nested, err := outputInHighLevelTransform(output.Structure, object)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d].%v", output.DisplayName, index, err)
+		}
+		elements = append(elements, nested)
+	}
+	return elements, nil
+}
+
+// toObject returns the value as an object, decoding strings that hold a JSON object
+func toObject(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case string:
+		if decoded, err := decodeJSON([]byte(v)); err == nil {
+			object, ok := decoded.(map[string]interface{})
+			return object, ok
+		}
+	}
+	return nil, false
+}
+
+// toArray returns the value as an array, decoding strings that hold a JSON array
+func toArray(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, true
+	case []map[string]interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			items = append(items, item)
+		}
+		return items, true
+	case string:
+		if decoded, err := decodeJSON([]byte(v)); err == nil {
+			items, ok := decoded.([]interface{})
+			return items, ok
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeRecords(t *testing.T) {
+	tests := []struct {
+		payload    string
+		want       []map[string]interface{}
+		wantSingle bool
+		wantErr    bool
+	}{
+		{payload: `{"id": 1, "name": "Ada"}`, want: []map[string]interface{}{{"id": int64(1), "name": "Ada"}}, wantSingle: true},
+		{payload: ` [{"id": 1}, {"id": 2.5}] `, want: []map[string]interface{}{{"id": int64(1)}, {"id": 2.5}}},
+		{payload: `[["id", "name"], [1, "Ada"], [2, "Alan"]]`, want: []map[string]interface{}{{"id": int64(1), "name": "Ada"}, {"id": int64(2), "name": "Alan"}}},
+		{payload: `[]`, want: []map[string]interface{}{}},
+		// Numbers that float64 cannot hold keep all their digits
+		{payload: `{"id": 12345678901234567890, "price": 1.0000000000000000001}`, want: []map[string]interface{}{{"id": json.Number("12345678901234567890"), "price": json.Number("1.0000000000000000001")}}, wantSingle: true},
+		{payload: `  `, wantErr: true},
+		{payload: "id,name\n1,Ada", wantErr: true},
+		{payload: `{"id": 1} {"id": 2}`, wantErr: true},
+		{payload: `[1, 2]`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		records, single, err := decodeRecords([]byte(test.payload))
+		if (err != nil) != test.wantErr {
+			t.Errorf("decodeRecords(%q) error = %v, want error %v", test.payload, err, test.wantErr)
+			continue
+		}
+		if single != test.wantSingle || !reflect.DeepEqual(records, test.want) {
+			t.Errorf("decodeRecords(%q) = %v, %v, want %v, %v", test.payload, records, single, test.want, test.wantSingle)
+		}
+	}
+}
+
+func TestPipelineSteps(t *testing.T) {
+	records := []map[string]interface{}{
+		{"id": int64(1), "name": "Ada", "address": map[string]interface{}{"city": "London"}, "tags": []interface{}{"a", "b"}},
+		{"id": int64(2), "name": "Alan", "country": nil, "tags": []interface{}{}},
+		{"id": int64(1), "name": "Ada", "address": map[string]interface{}{"city": "London"}, "tags": []interface{}{"a", "b"}},
+	}
+
+	tests := []struct {
+		name        string
+		steps       []TransformationStep
+		want        []map[string]interface{}
+		wantOrigins []int
+	}{
+		{
+			name:        "filter",
+			steps:       []TransformationStep{{Type: "FILTER", RuleType: `name == "Alan"`}, {Type: "DROP", Fields: []string{"tags", "country"}}},
+			want:        []map[string]interface{}{{"id": int64(2), "name": "Alan"}},
+			wantOrigins: []int{1},
+		},
+		{
+			name: "rename in order",
+			steps: []TransformationStep{
+				{Type: "FILTER", RuleType: "id == 2"},
+				{Type: "DROP", Fields: []string{"tags", "country"}},
+				{Type: "RENAME", Rename: renameList{{From: "name", To: "first"}, {From: "id", To: "name"}}},
+			},
+			want:        []map[string]interface{}{{"first": "Alan", "name": int64(2)}},
+			wantOrigins: []int{1},
+		},
+		{
+			name: "flatten and default",
+			steps: []TransformationStep{
+				{Type: "FILTER", RuleType: "id == 1"},
+				{Type: "DROP", Fields: []string{"tags"}},
+				{Type: "FLATTEN", Separator: "_"},
+				{Type: "DEFAULT", Values: map[string]interface{}{"country": "UK", "name": "unused"}},
+			},
+			want: []map[string]interface{}{
+				{"id": int64(1), "name": "Ada", "address_city": "London", "country": "UK"},
+				{"id": int64(1), "name": "Ada", "address_city": "London", "country": "UK"},
+			},
+			wantOrigins: []int{0, 2},
+		},
+		{
+			name: "deduplicate and explode",
+			steps: []TransformationStep{
+				{Type: "DEDUPLICATE"},
+				{Type: "EXPLODE", Field: "tags", As: "tag"},
+				{Type: "DROP", Fields: []string{"address", "tags", "name"}},
+			},
+			want:        []map[string]interface{}{{"id": int64(1), "tag": "a"}, {"id": int64(1), "tag": "b"}},
+			wantOrigins: []int{0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := transformRecords(records, finalOutputDataJSON{Steps: test.steps})
+			if len(result.Errors) > 0 {
+				t.Fatalf("errors = %v", result.Errors)
+			}
+			if !reflect.DeepEqual(result.Records, test.want) {
+				t.Errorf("records = %v, want %v", result.Records, test.want)
+			}
+			if !reflect.DeepEqual(result.origins, test.wantOrigins) {
+				t.Errorf("origins = %v, want %v", result.origins, test.wantOrigins)
+			}
+		})
+	}
+}
+
+func TestTransformReportsInputIndex(t *testing.T) {
+	records := []map[string]interface{}{
+		{"id": "1", "amount": "10"},
+		{"id": "2", "amount": "ten"},
+	}
+	result := transformRecords(records, finalOutputDataJSON{OutputFormat: []outputRuleStructure{
+		{Key: "id", DisplayName: "id", KeyType: "INT"},
+		{Key: "amount", DisplayName: "amount", KeyType: "FLOAT", OnError: "REJECT"},
+	}})
+
+	if len(result.Records) != 1 || result.Records[0]["amount"] != 10.0 {
+		t.Errorf("records = %v, want the first record only", result.Records)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Index != 1 {
+		t.Errorf("errors = %+v, want the record at index 1", result.Errors)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Key types accepted in OutputFormat entries
+var supportedKeyTypes = map[string]bool{
+	"STRING":       true,
+	"INT":          true,
+	"FLOAT":        true,
+	"BOOL":         true,
+	"DATE":         true,
+	"ARRAY_STRING": true,
+	"ARRAY_INT":    true,
+	"ARRAY_FLOAT":  true,
+	"ARRAY_BOOL":   true,
+	"ARRAY_DATE":   true,
+	"ARRAY_STRUCT": true,
+	"STRUCT":       true,
+}
+
+// Conversion failure policies accepted in OutputFormat entries
+var supportedOnErrorPolicies = map[string]bool{
+	"":             true,
+	onErrorNull:    true,
+	onErrorDefault: true,
+	onErrorReject:  true,
+}
+
+// FieldError describes a single invalid field of a configuration
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is the list of field level errors found in a configuration.
+// It is returned to the client with HTTP 400.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, 0, len(v))
+	for _, fieldError := range v {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// StatusCode makes GoFr respond with 400 Bad Request
+func (v ValidationErrors) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// add records an error for the given field
+func (v *ValidationErrors) add(field string, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateConfiguration checks every data source of a configuration before it is saved
+func validateConfiguration(configType string, data ConfigData) ValidationErrors {
+	var errs ValidationErrors
+	isSource := configType == "sourceConfig"
+
+	seenSources := make(map[int]bool)
+	for i, dataSource := range data.DataSourceConfig {
+		field := fmt.Sprintf("SourceData[%d]", i)
+
+		if seenSources[dataSource.Source] {
+			errs.add(field+".Source", "duplicate source %d", dataSource.Source)
+		}
+		seenSources[dataSource.Source] = true
+
+		if len(dataSource.Config) == 0 {
+			errs.add(field+".TYPEOF", "at least one connector is required")
+		}
+		for j, config := range dataSource.Config {
+			connectorField := fmt.Sprintf("%s.TYPEOF[%d]", field, j)
+			validateConnector(&errs, connectorField, config, isSource)
+
+			if config.SchemaRegistry != nil {
+				outputFormat := dataSource.TransformationConfig.OutputFormat
+				if config.TransformationConfig != nil {
+					outputFormat = config.TransformationConfig.OutputFormat
+				}
+				validateSchemaRegistry(&errs, connectorField+".SchemaRegistry", config, outputFormat)
+			}
+		}
+
+		validateTransformation(&errs, field+".TransformationConfig", dataSource.TransformationConfig)
+		validateSchema(&errs, field, dataSource)
+
+		if dataSource.DeadLetter != nil {
+			validateConnector(&errs, field+".DeadLetter", *dataSource.DeadLetter, false)
+			if dataSource.DeadLetter.SchemaRegistry != nil {
+				validateSchemaRegistry(&errs, field+".DeadLetter.SchemaRegistry", *dataSource.DeadLetter, deadLetterOutputFormat)
+			}
+		}
+	}
+	validateSecretReferences(&errs, data)
+
+	return errs
+}
+
+// validateConnector checks the fields required by a connector type
+func validateConnector(errs *ValidationErrors, field string, config Config, isSource bool) {
+	switch config.Type {
+	case "API":
+		validateURL(errs, field+".URL", config.URL)
+		if isSource {
+			requireField(errs, field+".Duration", config.Duration)
+		}
+	case "KAFKA":
+		requireField(errs, field+".IP", config.IP)
+		validatePort(errs, field+".Port", config.Port)
+		requireField(errs, field+".TopicName", config.TopicName)
+	case "DB":
+		if !isSource {
+			errs.add(field+".TYPE", "DB is only supported for sources")
+		}
+		requireField(errs, field+".DB_HOST", config.DBHost)
+		if config.DBPort <= 0 || config.DBPort > 65535 {
+			errs.add(field+".DB_PORT", "must be between 1 and 65535")
+		}
+		requireField(errs, field+".DB_USER", config.DBUser)
+		requireField(errs, field+".DB_NAME", config.DBName)
+		validateDatabase(errs, field, config)
+	case "POSTGRES_CDC":
+		validateCDC(errs, field, config, isSource)
+	case "CSV", "FILE":
+		requireField(errs, field+".FILE_PATH", config.FilePath)
+	case "":
+		errs.add(field+".TYPE", "is required")
+	default:
+		errs.add(field+".TYPE", "unknown connector type %q", config.Type)
+	}
+
+	if config.Duration != "" {
+		duration, err := parseDuration(config.Duration)
+		if err != nil {
+			errs.add(field+".Duration", "%v", err)
+		} else if duration <= 0 {
+			errs.add(field+".Duration", "must be greater than zero")
+		}
+	}
+
+	if config.OrderingWorkers < 0 {
+		errs.add(field+".OrderingWorkers", "must not be negative")
+	}
+
+	if config.Route != "" {
+		if err := validateRoute(config.Route); err != nil {
+			errs.add(field+".Route", "%v", err)
+		}
+	}
+
+	if config.TransformationConfig != nil {
+		validateTransformation(errs, field+".TransformationConfig", *config.TransformationConfig)
+	}
+	if config.Dedup != nil {
+		validateDedup(errs, field+".Dedup", config)
+	}
+	if config.ChangeDetection != nil {
+		validateChangeDetection(errs, field+".ChangeDetection", config)
+	}
+}
+
+// validateTransformation compiles the filter rule and checks the output format
+func validateTransformation(errs *ValidationErrors, field string, transformation finalOutputDataJSON) {
+	switch strings.ToUpper(transformation.FilterType) {
+	case "", filterTypeGval:
+		if transformation.RuleType != "" {
+			if _, err := compileExpression(transformation.RuleType); err != nil {
+				errs.add(field+".RuleType", "cannot parse rule: %v", err)
+			}
+		}
+	case filterTypeDeclarative:
+		if transformation.RuleType != "" {
+			if err := validateComplexRule(transformation.RuleType); err != nil {
+				errs.add(field+".RuleType", "cannot parse rule: %v", err)
+			}
+		}
+	default:
+		errs.add(field+".FilterType", "must be GVAL or DECLARATIVE")
+	}
+	if transformation.Filter != nil {
+		validateFilterGroup(errs, field+".Filter", *transformation.Filter)
+	}
+
+	validateSteps(errs, field+".Steps", transformation.Steps)
+	validateOutputFormat(errs, field+".OutputFormat", transformation.OutputFormat)
+}
+
+// validateOutputFormat checks key types, display names and nested structures
+func validateOutputFormat(errs *ValidationErrors, field string, outputFormat []outputRuleStructure) {
+	seenNames := make(map[string]bool)
+	for i, output := range outputFormat {
+		outputField := fmt.Sprintf("%s[%d]", field, i)
+
+		if output.DisplayName == "" {
+			errs.add(outputField+".DisplayName", "is required")
+		} else if seenNames[output.DisplayName] {
+			errs.add(outputField+".DisplayName", "duplicate display name %q", output.DisplayName)
+		}
+		seenNames[output.DisplayName] = true
+
+		if !supportedKeyTypes[output.KeyType] {
+			errs.add(outputField+".KeyType", "unsupported key type %q", output.KeyType)
+		}
+		if !supportedOnErrorPolicies[strings.ToUpper(output.OnError)] {
+			errs.add(outputField+".OnError", "must be NULL, DEFAULT or REJECT")
+		}
+		validateMask(errs, outputField, output)
+
+		for _, candidate := range sourceKeyCandidates(output.Key) {
+			if _, err := parsePath(candidate); err != nil {
+				errs.add(outputField+".Key", "%v", err)
+			}
+		}
+
+		if output.Rule != "" {
+			if _, err := compileExpression(output.Rule); err != nil {
+				errs.add(outputField+".Rule", "cannot parse rule: %v", err)
+			}
+		}
+
+		switch output.KeyType {
+		case "STRUCT", "ARRAY_STRUCT":
+			if output.Key == "" && output.Rule == "" && len(output.Structure) == 0 {
+				errs.add(outputField+".Structure", "Key or Structure is required for %s", output.KeyType)
+			}
+			validateOutputFormat(errs, outputField+".Structure", output.Structure)
+		default:
+			if output.Rule == "" {
+				requireField(errs, outputField+".Key", output.Key)
+			}
+		}
+	}
+}
+
+// requireField records an error when a mandatory string field is empty
+func requireField(errs *ValidationErrors, field string, value string) {
+	if strings.TrimSpace(value) == "" {
+		errs.add(field, "is required")
+	}
+}
+
+// validateSecretReferences checks the secret references of the fields tagged secret, so
+// that a blocked environment variable or file is reported when the configuration is
+// saved rather than when it is deployed
+func validateSecretReferences(errs *ValidationErrors, data ConfigData) {
+	walkStrings(reflect.ValueOf(&data).Elem(), "", indexName, func(field reflect.StructField, path string, value reflect.Value) {
+		if field.Tag.Get("secret") == "" || !isSecretReference(value.String()) {
+			return
+		}
+		if err := checkSecretReference(value.String()); err != nil {
+			errs.add(path, "%v", err)
+		}
+	})
+}
+
+// validateURL checks that the value is an absolute http or https URL. A URL with
+// secret references is checked once resolved, references that cannot be resolved yet
+// are left to validateSecretReferences and to the deploy.
+func validateURL(errs *ValidationErrors, field string, value string) {
+	if value == "" {
+		errs.add(field, "is required")
+		return
+	}
+	if isSecretReference(value) {
+		resolved, err := resolveConfigSecret(value)
+		if err != nil {
+			return
+		}
+		value = resolved
+	}
+	parsed, err := url.ParseRequestURI(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		errs.add(field, "must be an absolute http or https URL")
+	}
+}
+
+// validatePort checks that the value is a valid TCP port number
+func validatePort(errs *ValidationErrors, field string, value string) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 || port > 65535 {
+		errs.add(field, "must be a port number between 1 and 65535")
+	}
+}